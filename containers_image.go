@@ -0,0 +1,47 @@
+//go:build !exclude_containers_image
+// +build !exclude_containers_image
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/junaidk/image-backup-controller/controllers"
+)
+
+// registryBackends are the values of --registry-backend, the first one is the
+// default.
+var registryBackends = []string{controllers.REGISTRY_BACKEND_CONTAINERS_IMAGE, controllers.REGISTRY_BACKEND_DISTRIBUTION}
+
+func newRegistryBackend(name string, options registryBackendOptions) (registryBackend, error) {
+	switch name {
+	case controllers.REGISTRY_BACKEND_CONTAINERS_IMAGE:
+		return newContainerRegistryManager(options), nil
+	case controllers.REGISTRY_BACKEND_DISTRIBUTION:
+		return newDistributionRegistryManager(options), nil
+	}
+	return nil, fmt.Errorf("unknown registry backend %s", name)
+}
+
+// newArchiveRegistryManager returns the RegistryManager writing the backups to
+// archives in dir.
+func newArchiveRegistryManager(options registryBackendOptions, dir, format string) (controllers.RegistryManager, error) {
+	return &controllers.ArchiveRegistryManager{
+		Source: newContainerRegistryManager(options),
+		Dir:    dir,
+		Format: format,
+	}, nil
+}
+
+func newContainerRegistryManager(options registryBackendOptions) *controllers.ContainerRegistryManager {
+	return &controllers.ContainerRegistryManager{
+		RegistryConfig:     options.RegistryConfig,
+		RetryPolicy:        options.RetryPolicy,
+		RateLimiter:        options.RateLimiter,
+		ProgressInterval:   options.ProgressInterval,
+		BlobInfoCacheDir:   options.BlobInfoCacheDir,
+		TemporaryDir:       options.TemporaryDir,
+		RegistriesConfPath: options.RegistriesConfPath,
+		CredentialHelpers:  options.CredentialHelpers,
+	}
+}
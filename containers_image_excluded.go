@@ -0,0 +1,27 @@
+//go:build exclude_containers_image
+// +build exclude_containers_image
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/junaidk/image-backup-controller/controllers"
+)
+
+// registryBackends are the values of --registry-backend, the first one is the
+// default. Built with exclude_containers_image only the pure Go backend is
+// available.
+var registryBackends = []string{controllers.REGISTRY_BACKEND_DISTRIBUTION}
+
+func newRegistryBackend(name string, options registryBackendOptions) (registryBackend, error) {
+	if name != controllers.REGISTRY_BACKEND_DISTRIBUTION {
+		return nil, fmt.Errorf("registry backend %s is not available, the controller was built with exclude_containers_image", name)
+	}
+	return newDistributionRegistryManager(options), nil
+}
+
+func newArchiveRegistryManager(options registryBackendOptions, dir, format string) (controllers.RegistryManager, error) {
+	return nil, errors.New("backup archives need containers/image, the controller was built with exclude_containers_image")
+}
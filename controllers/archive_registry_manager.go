@@ -0,0 +1,141 @@
+//go:build !exclude_containers_image
+// +build !exclude_containers_image
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	ocilayout "github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+)
+
+// ArchiveRegistryManager writes images to a directory, e.g. a mounted
+// PersistentVolume, instead of a registry. The destination image name without
+// its registry host is the path below Dir:
+//
+//	oci:            Dir/<repository>/ is an OCI image layout, the tag names the image in it
+//	docker-archive: Dir/<repository>/<tag>.tar is a docker save tarball
+//
+// Images are pulled with the settings of Source. Destination credentials are
+// not used.
+type ArchiveRegistryManager struct {
+	Source *ContainerRegistryManager
+	Dir    string
+	Format string
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (a *ArchiveRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstCredentials *RegistryCredentials) error {
+	named, err := reference.ParseNormalizedNamed(dstImage)
+	if err != nil {
+		return permanentErrorf("invalid destination name %s: %v", dstImage, err)
+	}
+	tag := archiveTag(named)
+	repoDir := filepath.Join(a.Dir, filepath.FromSlash(reference.Path(named)))
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %v", err)
+	}
+
+	// only one copy may write to an OCI layout at a time, it shares its
+	// index.json between all tags
+	lock := a.lock(repoDir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	switch a.Format {
+	case ARCHIVE_FORMAT_DOCKER_ARCHIVE:
+		return a.copyToDockerArchive(ctx, srcImage, srcRegistryCredentials, named, filepath.Join(repoDir, tag+".tar"), tag)
+	case ARCHIVE_FORMAT_OCI, "":
+		destRef, err := ocilayout.NewReference(repoDir, tag)
+		if err != nil {
+			return permanentErrorf("invalid OCI layout destination %s: %v", repoDir, err)
+		}
+		return a.Source.copyImage(ctx, srcImage, srcRegistryCredentials, copyDestination{
+			ref: destRef,
+			sys: a.systemContext(),
+		})
+	default:
+		return permanentErrorf("unknown archive format %q", a.Format)
+	}
+}
+
+// copyToDockerArchive writes the image to a temporary file next to path and
+// renames it over path once complete. docker-archive can't overwrite an
+// existing tarball, and a failed copy doesn't destroy the previous backup.
+func (a *ArchiveRegistryManager) copyToDockerArchive(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials, named reference.Named, path, tag string) error {
+	namedTagged, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return permanentErrorf("invalid destination tag %s: %v", tag, err)
+	}
+
+	tmpPath := path + ".partial"
+	destRef, err := archive.NewReference(tmpPath, namedTagged)
+	if err != nil {
+		return permanentErrorf("invalid docker-archive destination %s: %v", path, err)
+	}
+	defer os.Remove(tmpPath)
+
+	err = a.Source.copyImage(ctx, srcImage, srcRegistryCredentials, copyDestination{
+		ref: destRef,
+		sys: a.systemContext(),
+		prepare: func() error {
+			// leftovers of a failed attempt
+			if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to move archive to %s: %v", path, err)
+	}
+	return nil
+}
+
+func (a *ArchiveRegistryManager) ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error) {
+	return a.Source.ImageSize(ctx, srcImage, srcRegistryCredentials)
+}
+
+func (a *ArchiveRegistryManager) systemContext() *types.SystemContext {
+	return &types.SystemContext{
+		BlobInfoCacheDir:     a.Source.BlobInfoCacheDir,
+		BigFilesTemporaryDir: a.Source.TemporaryDir,
+	}
+}
+
+func (a *ArchiveRegistryManager) lock(dir string) *sync.Mutex {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.locks == nil {
+		a.locks = make(map[string]*sync.Mutex)
+	}
+	if _, ok := a.locks[dir]; !ok {
+		a.locks[dir] = &sync.Mutex{}
+	}
+	return a.locks[dir]
+}
+
+// archiveTag returns the tag of named, "latest" if it has none. Digests are
+// turned into a valid tag, e.g. "sha256-abc...".
+func archiveTag(named reference.Named) string {
+	if tagged, ok := named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		return strings.Replace(digested.Digest().String(), ":", "-", 1)
+	}
+	return "latest"
+}
@@ -0,0 +1,38 @@
+//go:build !exclude_containers_image
+// +build !exclude_containers_image
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveTag(t *testing.T) {
+
+	tag := func(image string) string {
+		named, err := reference.ParseNormalizedNamed(image)
+		assert.NoError(t, err)
+		return archiveTag(named)
+	}
+
+	assert.Equal(t, "v1", tag("registry.local:5000/app:v1"))
+	assert.Equal(t, "latest", tag("registry.local:5000/app"))
+	assert.Equal(t, "sha256-"+testDigest, tag("registry.local:5000/app@sha256:"+testDigest))
+}
+
+func TestArchiveRegistryManagerFormat(t *testing.T) {
+
+	archive := &ArchiveRegistryManager{
+		Source: &ContainerRegistryManager{},
+		Dir:    t.TempDir(),
+		Format: "zip",
+	}
+	err := archive.CopyImage(context.Background(), "nginx", "backup.local/nginx:latest", nil, nil)
+	assert.True(t, IsPermanentError(err))
+}
+
+const testDigest = "0000000000000000000000000000000000000000000000000000000000000000"
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	BACKUP_SECRET_USERNAME_KEY = "username"
+	BACKUP_SECRET_PASSWORD_KEY = "password"
+
+	EVENT_REASON_CREDENTIALS_RELOADED = "CredentialsReloaded"
+	EVENT_REASON_CREDENTIALS_INVALID  = "InvalidCredentials"
+)
+
+// BackupCredentials holds the credentials of the backup registry. They may be
+// replaced while the controller runs, so they are read once per reconcile
+// and never modified in place.
+type BackupCredentials struct {
+	mu          sync.RWMutex
+	credentials *RegistryCredentials
+	changed     chan struct{}
+}
+
+func NewBackupCredentials(credentials *RegistryCredentials) *BackupCredentials {
+	return &BackupCredentials{credentials: credentials, changed: make(chan struct{})}
+}
+
+func (b *BackupCredentials) Get() *RegistryCredentials {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.credentials
+}
+
+func (b *BackupCredentials) Set(credentials *RegistryCredentials) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.credentials = credentials
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed when the credentials are replaced
+// the next time.
+func (b *BackupCredentials) Changed() <-chan struct{} {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.changed
+}
+
+// LoadBackupCredentials reads the credentials of the backup registry at url
+// from the Secret key. username is used if the Secret has none.
+func LoadBackupCredentials(ctx context.Context, reader client.Reader, key types.NamespacedName, url, username string) (*RegistryCredentials, error) {
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, key, secret); err != nil {
+		return nil, fmt.Errorf("failed to get backup registry secret %s: %w", key, err)
+	}
+	return backupCredentialsFromSecret(secret, url, username)
+}
+
+func backupCredentialsFromSecret(secret *corev1.Secret, url, username string) (*RegistryCredentials, error) {
+	if secretUsername, ok := secret.Data[BACKUP_SECRET_USERNAME_KEY]; ok {
+		username = strings.TrimSpace(string(secretUsername))
+	}
+	password, ok := secret.Data[BACKUP_SECRET_PASSWORD_KEY]
+	if !ok {
+		return nil, fmt.Errorf("backup registry secret %s/%s has no %s", secret.Namespace, secret.Name, BACKUP_SECRET_PASSWORD_KEY)
+	}
+	if username == "" {
+		return nil, fmt.Errorf("backup registry secret %s/%s has no %s", secret.Namespace, secret.Name, BACKUP_SECRET_USERNAME_KEY)
+	}
+	return &RegistryCredentials{
+		URL:      url,
+		Username: username,
+		Password: strings.TrimSpace(string(password)),
+	}, nil
+}
+
+// BackupCredentialsReconciler reloads the backup registry credentials when
+// their Secret changes. New credentials are only used once Validate accepted
+// them, until then the previous ones stay in use.
+type BackupCredentialsReconciler struct {
+	client.Client
+	SecretKey   types.NamespacedName
+	Credentials *BackupCredentials
+	// Validate logs into the backup registry with new credentials.
+	Validate func(ctx context.Context, credentials *RegistryCredentials) error
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func (r *BackupCredentialsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	lg := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	err := r.Client.Get(ctx, r.SecretKey, secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			lg.Info("backup registry secret not found, keeping the current credentials")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	current := r.Credentials.Get()
+	credentials, err := backupCredentialsFromSecret(secret, current.URL, current.Username)
+	if err != nil {
+		r.Recorder.Event(secret, corev1.EventTypeWarning, EVENT_REASON_CREDENTIALS_INVALID, err.Error())
+		return ctrl.Result{}, nil
+	}
+	if *credentials == *current {
+		return ctrl.Result{}, nil
+	}
+	// the username names the backup images, changing it would back up every image again
+	if credentials.Username != current.Username {
+		r.Recorder.Eventf(secret, corev1.EventTypeWarning, EVENT_REASON_CREDENTIALS_INVALID,
+			"Username changed from %s to %s, restart the controller to back up to the new user", current.Username, credentials.Username)
+		return ctrl.Result{}, nil
+	}
+
+	if r.Validate != nil {
+		if err := r.Validate(ctx, credentials); err != nil {
+			r.Recorder.Eventf(secret, corev1.EventTypeWarning, EVENT_REASON_CREDENTIALS_INVALID, "Failed to log into %s, keeping the current credentials: %v", credentials.URL, err)
+			if isUnauthorizedError(err) {
+				return ctrl.Result{}, nil
+			}
+			// the registry may be unavailable, try again with backoff
+			return ctrl.Result{}, err
+		}
+	}
+
+	r.Credentials.Set(credentials)
+	lg.Info("reloaded backup registry credentials", "secret", r.SecretKey)
+	r.Recorder.Eventf(secret, corev1.EventTypeNormal, EVENT_REASON_CREDENTIALS_RELOADED, "Reloaded the credentials of %s", credentials.URL)
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager, it only watches
+// the Secret of the credentials.
+func (r *BackupCredentialsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("backup-credentials").
+		For(&corev1.Secret{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return obj.GetNamespace() == r.SecretKey.Namespace && obj.GetName() == r.SecretKey.Name
+		}))).
+		Complete(r)
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestBackupCredentialsReload(t *testing.T) {
+
+	registry := newTestRegistry(t, "backup", "new-password")
+	registryManager := &DistributionRegistryManager{RegistryConfig: testRegistryConfig(t, registry)}
+
+	key := types.NamespacedName{Namespace: "image-backup", Name: "registry-creds"}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Data:       map[string][]byte{"username": []byte("backup"), "password": []byte("wrong-password")},
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(secret).Build()
+
+	initial := &RegistryCredentials{URL: registry.Host, Username: "backup", Password: "old-password"}
+	credentials := NewBackupCredentials(initial)
+	recorder := record.NewFakeRecorder(10)
+	r := &BackupCredentialsReconciler{
+		Client:      k8sClient,
+		SecretKey:   key,
+		Credentials: credentials,
+		Validate:    registryManager.CheckCredentials,
+		Recorder:    recorder,
+	}
+	reconcile := func() {
+		result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+		require.NoError(t, err)
+		assert.Equal(t, ctrl.Result{}, result)
+	}
+
+	// rejected credentials are not used
+	reconcile()
+	assert.Same(t, initial, credentials.Get())
+	assert.Contains(t, <-recorder.Events, EVENT_REASON_CREDENTIALS_INVALID)
+
+	secret.Data["password"] = []byte("new-password\n")
+	require.NoError(t, k8sClient.Update(context.Background(), secret))
+	reconcile()
+	assert.Equal(t, &RegistryCredentials{URL: registry.Host, Username: "backup", Password: "new-password"}, credentials.Get())
+	assert.Contains(t, <-recorder.Events, EVENT_REASON_CREDENTIALS_RELOADED)
+
+	// the username names the backup images and needs a restart
+	secret.Data["username"] = []byte("other")
+	require.NoError(t, k8sClient.Update(context.Background(), secret))
+	reconcile()
+	assert.Equal(t, "backup", credentials.Get().Username)
+	assert.Contains(t, <-recorder.Events, EVENT_REASON_CREDENTIALS_INVALID)
+}
+
+func TestBackupCredentialsFromSecret(t *testing.T) {
+
+	secret := &corev1.Secret{Data: map[string][]byte{"password": []byte("password")}}
+	credentials, err := backupCredentialsFromSecret(secret, "registry.example.com", "env-user")
+	assert.NoError(t, err)
+	assert.Equal(t, &RegistryCredentials{URL: "registry.example.com", Username: "env-user", Password: "password"}, credentials)
+
+	_, err = backupCredentialsFromSecret(secret, "registry.example.com", "")
+	assert.Error(t, err)
+
+	_, err = backupCredentialsFromSecret(&corev1.Secret{Data: map[string][]byte{"username": []byte("user")}}, "registry.example.com", "")
+	assert.Error(t, err)
+}
@@ -3,8 +3,12 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"strings"
 
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
@@ -15,6 +19,21 @@ import (
 
 const (
 	DEFAULT_DOCKER_REGISTRY = "index.docker.io"
+	DEFAULT_SERVICE_ACCOUNT = "default"
+)
+
+const (
+	EVENT_REASON_COPY_FAILED    = "ImageCopyFailed"
+	EVENT_REASON_COPY_RETRYING  = "ImageCopyRetrying"
+	EVENT_REASON_COPY_SKIPPED   = "ImageBackupSkipped"
+	EVENT_REASON_INVALID_CONFIG = "InvalidConfiguration"
+	// EVENT_REASON_REPLICA_FAILED reports a failed copy to a secondary backup
+	// destination that the backup policy tolerates.
+	EVENT_REASON_REPLICA_FAILED = "ImageReplicationFailed"
+	// EVENT_REASON_SCAN_* report the verdicts of the scanner on backup images.
+	EVENT_REASON_SCAN_PASSED   = "ImageScanPassed"
+	EVENT_REASON_SCAN_REJECTED = "ImageScanRejected"
+	EVENT_REASON_SCAN_ERROR    = "ImageScanError"
 )
 
 func getDestinationImageName(image, registryURL, registryUser string) string {
@@ -34,62 +53,170 @@ func getRegistrySecret(ctx context.Context, k8sClient client.Client, name, names
 	return regSecret, nil
 }
 
+// createRegistrySecret creates secret, or updates it if it exists with other
+// credentials. Secrets the controller doesn't manage are never overwritten.
 func createRegistrySecret(ctx context.Context, k8sClient client.Client, secret *corev1.Secret) error {
 	existingSecret := &corev1.Secret{}
 	err := k8sClient.Get(ctx, client.ObjectKey{Name: secret.Name, Namespace: secret.Namespace}, existingSecret)
 	if err != nil {
 		if errors.IsNotFound(err) {
-			err = k8sClient.Create(ctx, secret)
-			if err != nil {
-				return err
-			}
-		} else {
-			existingSecret.Data = secret.Data
-			err = k8sClient.Update(ctx, existingSecret)
-			return err
+			return k8sClient.Create(ctx, secret)
 		}
+		return err
+	}
+	if !canUpdateSecret(existingSecret, secret) {
+		return permanentErrorf("secret %s/%s exists and isn't managed by the controller, remove it or set a different PULL_SECRET_NAME", secret.Namespace, secret.Name)
+	}
+	return updateRegistrySecret(ctx, k8sClient, existingSecret, secret)
+}
+
+// updateRegistrySecret sets the data and labels of secret to the ones of
+// desired unless it already has them.
+func updateRegistrySecret(ctx context.Context, k8sClient client.Client, secret, desired *corev1.Secret) error {
+	labels := secret.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	updated := !reflect.DeepEqual(secret.Data, desired.Data)
+	for key, value := range desired.Labels {
+		if labels[key] != value {
+			labels[key] = value
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
 	}
-	return nil
+	secret.Data = desired.Data
+	secret.SetLabels(labels)
+	return k8sClient.Update(ctx, secret)
 }
 
-func getRegistryCredentials(ctx context.Context, k8sclient client.Client, imgPullSecrets []corev1.LocalObjectReference, namespace string) (map[string]*RegistryCredentials, error) {
-	registryCredentials := make(map[string]*RegistryCredentials)
+// getRegistryCredentials returns the keyring of all entries of the pull
+// secrets of podSpec and of its ServiceAccount. For equal registries the
+// secrets of podSpec win. Like the kubelet does, malformed and unsupported
+// pull secrets are skipped, their errors are returned to be reported.
+func getRegistryCredentials(ctx context.Context, k8sclient client.Client, podSpec *corev1.PodSpec, namespace string) (*registryKeyring, []error, error) {
+	keyring := &registryKeyring{}
+	var invalid []error
 
-	for _, secret := range imgPullSecrets {
-		registryCredential, err := getRegistryCredential(ctx, k8sclient, secret.Name, namespace)
+	for _, secret := range podSpec.ImagePullSecrets {
+		registryCredentials, err := getRegistryCredential(ctx, k8sclient, secret.Name, namespace)
 		if err != nil {
-			return nil, err
+			if IsPermanentError(err) {
+				invalid = append(invalid, err)
+				continue
+			}
+			return nil, nil, err
 		}
-		registryCredentials[registryCredential.URL] = &RegistryCredentials{
-			URL:      registryCredential.URL,
-			Username: registryCredential.Username,
-			Password: registryCredential.Password,
+		keyring.add(registryCredentials...)
+	}
+
+	serviceAccountSecrets, err := getServiceAccountPullSecrets(ctx, k8sclient, podSpec, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, secret := range serviceAccountSecrets {
+		registryCredentials, err := getRegistryCredential(ctx, k8sclient, secret.Name, namespace)
+		if err != nil {
+			// like the kubelet, ignore missing secrets of the ServiceAccount
+			if errors.IsNotFound(err) {
+				continue
+			}
+			if IsPermanentError(err) {
+				invalid = append(invalid, err)
+				continue
+			}
+			return nil, nil, err
+		}
+		keyring.add(registryCredentials...)
+	}
+	return keyring, invalid, nil
+}
+
+// getServiceAccountPullSecrets returns the imagePullSecrets of the
+// ServiceAccount of podSpec, the default one of namespace if unset. A missing
+// ServiceAccount has none.
+func getServiceAccountPullSecrets(ctx context.Context, k8sclient client.Client, podSpec *corev1.PodSpec, namespace string) ([]corev1.LocalObjectReference, error) {
+	name := podSpec.ServiceAccountName
+	if name == "" {
+		name = DEFAULT_SERVICE_ACCOUNT
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	err := k8sclient.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, serviceAccount)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
 		}
+		return nil, fmt.Errorf("error getting service account: %v", err)
 	}
-	return registryCredentials, nil
+	return serviceAccount.ImagePullSecrets, nil
 }
 
-func getRegistryCredential(ctx context.Context, k8sclient client.Client, secretName, namespace string) (*RegistryCredentials, error) {
+func getRegistryCredential(ctx context.Context, k8sclient client.Client, secretName, namespace string) ([]*RegistryCredentials, error) {
 	var regCreds *corev1.Secret
 	var err error
 
 	regCreds, err = getRegistrySecret(ctx, k8sclient, secretName, namespace)
 	if err != nil {
-		return nil, fmt.Errorf("error getting registry secret: %v", err)
+		return nil, fmt.Errorf("error getting registry secret: %w", err)
 	}
 
-	var registryCreds *RegistryCredentials
-	if regCreds != nil {
-		if regCreds.Type == corev1.SecretTypeDockerConfigJson {
-			registryCreds, err = getRegistryCredentialsFromDockerCfg(regCreds.Data[corev1.DockerConfigJsonKey])
-			if err != nil {
-				return nil, fmt.Errorf("failed to get auth from docker config: %v", err)
-			}
+	// malformed secrets don't fix themselves, they are returned as permanent errors
+	var registryCreds []*RegistryCredentials
+	switch regCreds.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		data, ok := regCreds.Data[corev1.DockerConfigJsonKey]
+		if !ok {
+			return nil, permanentErrorf("registry secret %s has no %s", secretName, corev1.DockerConfigJsonKey)
+		}
+		registryCreds, err = getRegistryCredentialsFromDockerCfg(data)
+	case corev1.SecretTypeDockercfg:
+		data, ok := regCreds.Data[corev1.DockerConfigKey]
+		if !ok {
+			return nil, permanentErrorf("registry secret %s has no %s", secretName, corev1.DockerConfigKey)
 		}
+		registryCreds, err = getRegistryCredentialsFromLegacyDockerCfg(data)
+	default:
+		return nil, permanentErrorf("registry secret %s has unsupported type %s, expected %s or %s",
+			secretName, regCreds.Type, corev1.SecretTypeDockerConfigJson, corev1.SecretTypeDockercfg)
+	}
+	if err != nil {
+		return nil, permanentErrorf("failed to get auth from docker config of registry secret %s: %v", secretName, err)
 	}
 	return registryCreds, nil
 }
 
+// copyFailureResult reports a failed image copy on the workload. Transient
+// failures are requeued with exponential backoff, permanent ones are not
+// retried until the workload spec changes.
+func copyFailureResult(recorder record.EventRecorder, obj runtime.Object, image string, err error) ctrl.Result {
+	if IsPermanentError(err) {
+		recorder.Eventf(obj, corev1.EventTypeWarning, EVENT_REASON_COPY_FAILED, "Failed to back up image %s: %v", image, err)
+		return ctrl.Result{}
+	}
+	recorder.Eventf(obj, corev1.EventTypeWarning, EVENT_REASON_COPY_RETRYING, "Failed to back up image %s, will retry: %v", image, err)
+	return ctrl.Result{Requeue: true}
+}
+
+// recordSkippedCopies reports every skipped copy on the workload and returns
+// the skipped source images.
+func recordSkippedCopies(recorder record.EventRecorder, obj runtime.Object, jobs []CopyJob, statuses []CopyStatus) map[string]error {
+	skipped := skippedCopies(jobs, statuses)
+	for image, reason := range skipped {
+		recorder.Eventf(obj, corev1.EventTypeWarning, EVENT_REASON_COPY_SKIPPED, "Image %s is not backed up: %v", image, reason)
+	}
+	return skipped
+}
+
+// recordFailedReplicaCopies reports every failed copy to a secondary backup
+// destination on the workload.
+func recordFailedReplicaCopies(recorder record.EventRecorder, obj runtime.Object, jobs []CopyJob, statuses []CopyStatus) {
+	for replica, err := range failedReplicaCopies(jobs, statuses) {
+		recorder.Eventf(obj, corev1.EventTypeWarning, EVENT_REASON_REPLICA_FAILED, "Failed to replicate image %s: %v", replica, err)
+	}
+}
+
 func ignorePredicate(ignoreNamespaces []string) predicate.Predicate {
 
 	return predicate.Funcs{
@@ -112,3 +239,23 @@ func ignorePredicate(ignoreNamespaces []string) predicate.Predicate {
 		},
 	}
 }
+
+// recordScanResults reports the scan results on the workload and returns the
+// source images whose backup was rejected.
+func recordScanResults(recorder record.EventRecorder, obj runtime.Object, jobs []CopyJob, results map[string]ScanResult) map[string]string {
+	for _, job := range jobs {
+		result, ok := results[job.SrcImage]
+		if !ok {
+			continue
+		}
+		switch result.Verdict {
+		case SCAN_VERDICT_PASS:
+			recorder.Eventf(obj, corev1.EventTypeNormal, EVENT_REASON_SCAN_PASSED, "Image %s passed the scan", job.DstImage)
+		case SCAN_VERDICT_FAIL:
+			recorder.Eventf(obj, corev1.EventTypeWarning, EVENT_REASON_SCAN_REJECTED, "Image %s failed the scan, keeping %s: %s", job.DstImage, job.SrcImage, result.Reason)
+		case SCAN_VERDICT_ERROR:
+			recorder.Eventf(obj, corev1.EventTypeWarning, EVENT_REASON_SCAN_ERROR, "Image %s was not scanned, failing open: %s", job.DstImage, result.Reason)
+		}
+	}
+	return failedScans(results)
+}
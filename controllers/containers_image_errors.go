@@ -0,0 +1,23 @@
+//go:build !exclude_containers_image
+// +build !exclude_containers_image
+
+package controllers
+
+import (
+	"errors"
+
+	"github.com/containers/image/v5/docker"
+)
+
+// isDockerTooManyRequestsError reports whether containers/image was rejected
+// with 429 Too Many Requests.
+func isDockerTooManyRequestsError(err error) bool {
+	return errors.Is(err, docker.ErrTooManyRequests)
+}
+
+// isDockerUnauthorizedError reports whether containers/image was rejected
+// with 401 Unauthorized.
+func isDockerUnauthorizedError(err error) bool {
+	var unauthorizedErr docker.ErrUnauthorizedForCredentials
+	return errors.As(err, &unauthorizedErr)
+}
@@ -0,0 +1,14 @@
+//go:build exclude_containers_image
+// +build exclude_containers_image
+
+package controllers
+
+// Without containers/image there are no errors of it to recognize.
+
+func isDockerTooManyRequestsError(err error) bool {
+	return false
+}
+
+func isDockerUnauthorizedError(err error) bool {
+	return false
+}
@@ -0,0 +1,476 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	DEFAULT_COPY_WORKERS          = 4
+	DEFAULT_COPY_RESULT_TTL       = time.Minute * 10
+	DEFAULT_COPY_TIMEOUT          = time.Minute * 30
+	DEFAULT_COPY_SHUTDOWN_TIMEOUT = time.Minute
+)
+
+// CopyJob is a single image copy from a source registry to a backup
+// destination.
+type CopyJob struct {
+	SrcImage       string
+	DstImage       string
+	SrcCredentials *RegistryCredentials
+	// DstCredentials are replaced by CopyQueue.BackupCredentials at copy time
+	// for jobs to the primary registry.
+	DstCredentials *RegistryCredentials
+	// MaxSize skips images larger than MaxSize bytes, zero copies any image.
+	MaxSize int64
+	// Destination names the backup destination, empty for the primary backup
+	// registry.
+	Destination string
+}
+
+func (j CopyJob) key() string {
+	key := j.SrcImage + " -> " + j.DstImage
+	if j.Destination != "" {
+		key = j.Destination + ": " + key
+	}
+	if j.MaxSize > 0 {
+		key = fmt.Sprintf("%s (max %d)", key, j.MaxSize)
+	}
+	// workloads pulling with other credentials don't share results
+	return key + " as " + credentialsKey(j.SrcCredentials)
+}
+
+// credentialsKey identifies credentials in job keys without holding the
+// secrets themselves.
+func credentialsKey(credentials *RegistryCredentials) string {
+	if credentials == nil {
+		credentials = &RegistryCredentials{}
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		credentials.URL, credentials.Username, credentials.Password, credentials.IdentityToken, credentials.RegistryToken,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (j CopyJob) destinationName() string {
+	if j.Destination == "" {
+		return PRIMARY_DESTINATION
+	}
+	return j.Destination
+}
+
+type CopyState string
+
+const (
+	CopyPending   CopyState = "Pending"
+	CopySucceeded CopyState = "Succeeded"
+	CopyFailed    CopyState = "Failed"
+	// CopySkipped means the image was deliberately not copied, Err holds the
+	// reason.
+	CopySkipped CopyState = "Skipped"
+)
+
+type CopyStatus struct {
+	State       CopyState
+	Err         error
+	BytesCopied int64
+	BytesTotal  int64
+	// Scan is the verdict of the scanner on the backup image of a succeeded
+	// copy to the primary registry, nil if it wasn't scanned.
+	Scan *ScanResult
+	// ScanErr is set if the scanner failed and doesn't fail open.
+	ScanErr error
+}
+
+// copyWaiter identifies a workload waiting for a copy and the channel its
+// reconciler watches for copy events.
+type copyWaiter struct {
+	events chan<- event.GenericEvent
+	key    types.NamespacedName
+}
+
+type copyTask struct {
+	job      CopyJob
+	status   CopyStatus
+	finished time.Time
+	progress *CopyProgress
+	waiters  map[copyWaiter]client.Object
+	// notified are the waiters that got the result of the finished task.
+	notified map[copyWaiter]client.Object
+	// scanOnly scans the copied image again instead of copying it.
+	scanOnly bool
+}
+
+func (t *copyTask) currentStatus() CopyStatus {
+	status := t.status
+	status.BytesCopied = t.progress.BytesCopied()
+	status.BytesTotal = t.progress.BytesTotal()
+	return status
+}
+
+// CopyQueue copies images in its own worker goroutines so reconciles don't
+// block on large images. Jobs are deduplicated by source and destination
+// image, every workload waiting for a job is reconciled again through its
+// events channel once the job finished. Results are kept for ResultTTL so
+// the woken up reconciles can pick them up.
+//
+// A single copy is cancelled after CopyTimeout. On shutdown no new copies are
+// started and running ones get ShutdownTimeout to finish before they are
+// cancelled.
+//
+// With a Scanner, the copies to the primary registry are scanned by the same
+// worker once they succeeded, and the verdict is kept with their result.
+//
+// With BackupCredentials, copies to the primary registry push with the
+// credentials current when they start. Copies the registry rejected are
+// forgotten when the credentials are reloaded, and their workloads are
+// reconciled again.
+type CopyQueue struct {
+	RegistryManager RegistryManager
+	// Destinations holds the registry managers of jobs with a Destination.
+	Destinations map[string]RegistryManager
+	// BackupCredentials, if set, are the credentials of the primary registry.
+	BackupCredentials *BackupCredentials
+	// Scanner, if set, scans the backup images of jobs without a Destination.
+	Scanner         *ImageScanner
+	Workers         int
+	ResultTTL       time.Duration
+	CopyTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	mu       sync.Mutex
+	tasks    map[string]*copyTask
+	pruned   time.Time
+	queue    workqueue.Interface
+	stopping chan struct{}
+}
+
+func NewCopyQueue(registryManager RegistryManager, workers int) *CopyQueue {
+	if workers < 1 {
+		workers = DEFAULT_COPY_WORKERS
+	}
+	return &CopyQueue{
+		RegistryManager: registryManager,
+		Workers:         workers,
+		ResultTTL:       DEFAULT_COPY_RESULT_TTL,
+		CopyTimeout:     DEFAULT_COPY_TIMEOUT,
+		ShutdownTimeout: DEFAULT_COPY_SHUTDOWN_TIMEOUT,
+		tasks:           make(map[string]*copyTask),
+		queue:           workqueue.NewNamed("image-copy"),
+		stopping:        make(chan struct{}),
+	}
+}
+
+// Enqueue returns the status of job, queueing it if it isn't known yet. While
+// the job is pending obj is registered to be sent to events when it finishes.
+func (q *CopyQueue) Enqueue(job CopyJob, events chan<- event.GenericEvent, obj client.Object) CopyStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+	key := job.key()
+	task, ok := q.tasks[key]
+	if ok && q.expired(task) {
+		delete(q.tasks, key)
+		ok = false
+	}
+	if ok && task.scanOnly && task.status.State != CopyPending {
+		task.status = CopyStatus{State: CopyPending}
+		task.waiters = make(map[copyWaiter]client.Object)
+		q.queue.Add(key)
+	}
+	if !ok {
+		task = &copyTask{
+			job:      job,
+			status:   CopyStatus{State: CopyPending},
+			progress: &CopyProgress{},
+			waiters:  make(map[copyWaiter]client.Object),
+		}
+		q.tasks[key] = task
+		q.queue.Add(key)
+	}
+
+	if task.status.State == CopyPending {
+		waiter := copyWaiter{events: events, key: client.ObjectKeyFromObject(obj)}
+		task.waiters[waiter] = obj.DeepCopyObject().(client.Object)
+	}
+	return task.currentStatus()
+}
+
+// Rescan keeps the copy of job whose scan failed, the next Enqueue only scans
+// it again.
+func (q *CopyQueue) Rescan(job CopyJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if task, ok := q.tasks[job.key()]; ok && task.status.ScanErr != nil {
+		task.scanOnly = true
+	}
+}
+
+// expired reports whether task finished more than ResultTTL ago. Must be
+// called with q.mu held.
+func (q *CopyQueue) expired(task *copyTask) bool {
+	return task.status.State != CopyPending && time.Since(task.finished) > q.ResultTTL
+}
+
+// prune drops the expired results of jobs no workload asked for again, at
+// most once per ResultTTL. Must be called with q.mu held.
+func (q *CopyQueue) prune() {
+	if time.Since(q.pruned) < q.ResultTTL {
+		return
+	}
+	q.pruned = time.Now()
+	for key, task := range q.tasks {
+		if q.expired(task) {
+			delete(q.tasks, key)
+		}
+	}
+}
+
+// Forget drops the result of job so the next Enqueue copies it again.
+func (q *CopyQueue) Forget(job CopyJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if task, ok := q.tasks[job.key()]; ok && task.status.State != CopyPending {
+		delete(q.tasks, job.key())
+	}
+}
+
+// Start runs the copy workers until ctx is done, then drains the queue.
+func (q *CopyQueue) Start(ctx context.Context) error {
+	lg := log.FromContext(ctx)
+
+	// copies run with their own context, so they are not cancelled as soon
+	// as the manager shuts down
+	copyCtx, cancelCopies := context.WithCancel(log.IntoContext(context.Background(), lg))
+	defer cancelCopies()
+
+	if q.BackupCredentials != nil {
+		// taken before the first copy starts, so no reload is missed
+		go q.retryUnauthorized(ctx, q.BackupCredentials.Changed())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q.processNext(copyCtx) {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	lg.Info("stopping copy queue, waiting for running copies")
+	close(q.stopping)
+	q.queue.ShutDown()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(q.ShutdownTimeout):
+		lg.Info("cancelling running copies", "shutdownTimeout", q.ShutdownTimeout)
+		cancelCopies()
+		<-drained
+	}
+	return nil
+}
+
+func (q *CopyQueue) processNext(ctx context.Context) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	select {
+	case <-q.stopping:
+		// don't start copies that were still queued at shutdown
+		return true
+	default:
+	}
+
+	key := item.(string)
+	q.mu.Lock()
+	task, ok := q.tasks[key]
+	scanOnly := ok && task.scanOnly
+	q.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	lg := log.FromContext(ctx).WithValues("srcImage", task.job.SrcImage, "dstImage", task.job.DstImage, "destination", task.job.destinationName())
+
+	status := CopyStatus{State: CopySucceeded}
+	if !scanOnly {
+		lg.Info("copying image")
+		copyCtx, cancel := context.WithTimeout(withCopyProgress(ctx, task.progress), q.CopyTimeout)
+		status = q.copy(copyCtx, task.job)
+		cancel()
+	}
+	switch status.State {
+	case CopyFailed:
+		lg.Error(status.Err, "failed to copy image")
+	case CopySkipped:
+		lg.Info("skipped image", "reason", status.Err.Error())
+	case CopySucceeded:
+		if q.Scanner != nil && task.job.Destination == "" {
+			status.Scan, status.ScanErr = q.Scanner.scanCopy(ctx, task.job)
+			if status.ScanErr != nil {
+				lg.Error(status.ScanErr, "failed to scan image")
+			}
+		}
+	}
+
+	q.mu.Lock()
+	task.status = status
+	task.finished = time.Now()
+	task.scanOnly = false
+	waiters := task.waiters
+	task.waiters = nil
+	task.notified = waiters
+	q.mu.Unlock()
+
+	q.notify(waiters)
+	return true
+}
+
+// notify sends the workloads of waiters to their reconcilers.
+func (q *CopyQueue) notify(waiters map[copyWaiter]client.Object) {
+	for waiter, obj := range waiters {
+		select {
+		case waiter.events <- event.GenericEvent{Object: obj}:
+		case <-q.stopping:
+			// the reconcilers are stopping and don't receive events anymore
+			return
+		}
+	}
+}
+
+// retryUnauthorized forgets the copies to the primary registry that failed
+// to authenticate whenever BackupCredentials change, and wakes up the
+// workloads that got their results so they are copied with the new
+// credentials.
+func (q *CopyQueue) retryUnauthorized(ctx context.Context, changed <-chan struct{}) {
+	for {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+		// taken before forgetting, so a reload in between isn't missed
+		changed = q.BackupCredentials.Changed()
+
+		waiters := make(map[copyWaiter]client.Object)
+		q.mu.Lock()
+		for key, task := range q.tasks {
+			if task.job.Destination != "" || task.status.State != CopyFailed || !isUnauthorizedError(task.status.Err) {
+				continue
+			}
+			delete(q.tasks, key)
+			for waiter, obj := range task.notified {
+				waiters[waiter] = obj
+			}
+		}
+		q.mu.Unlock()
+		log.FromContext(ctx).Info("backup registry credentials changed, retrying rejected copies", "workloads", len(waiters))
+		q.notify(waiters)
+	}
+}
+
+// copy checks the image size if the job has a limit and copies the image.
+func (q *CopyQueue) copy(ctx context.Context, job CopyJob) CopyStatus {
+	registryManager := q.RegistryManager
+	if job.Destination != "" {
+		var ok bool
+		if registryManager, ok = q.Destinations[job.Destination]; !ok {
+			return CopyStatus{State: CopyFailed, Err: permanentErrorf("unknown backup destination %s", job.Destination)}
+		}
+	}
+
+	if job.MaxSize > 0 {
+		size, err := registryManager.ImageSize(ctx, job.SrcImage, job.SrcCredentials)
+		if err != nil {
+			return CopyStatus{State: CopyFailed, Err: err}
+		}
+		if size > job.MaxSize {
+			return CopyStatus{State: CopySkipped, Err: &ImageTooLargeError{Image: job.SrcImage, Size: size, MaxSize: job.MaxSize}}
+		}
+	}
+
+	dstCredentials := job.DstCredentials
+	if job.Destination == "" && q.BackupCredentials != nil {
+		// the credentials may have been reloaded since the job was queued
+		dstCredentials = q.BackupCredentials.Get()
+	}
+	if err := registryManager.CopyImage(ctx, job.SrcImage, job.DstImage, job.SrcCredentials, dstCredentials); err != nil {
+		return CopyStatus{State: CopyFailed, Err: err}
+	}
+	return CopyStatus{State: CopySucceeded}
+}
+
+// queueImageCopies queues jobs and returns their status. Transient failures
+// are forgotten so the copy is attempted again when the workload is requeued,
+// failed scans only scan the copied image again.
+func queueImageCopies(queue *CopyQueue, events chan<- event.GenericEvent, obj client.Object, jobs []CopyJob) []CopyStatus {
+	statuses := make([]CopyStatus, len(jobs))
+	for i := range jobs {
+		statuses[i] = queue.Enqueue(jobs[i], events, obj)
+		if statuses[i].State == CopyFailed && !IsPermanentError(statuses[i].Err) {
+			queue.Forget(jobs[i])
+		}
+		if statuses[i].ScanErr != nil {
+			queue.Rescan(jobs[i])
+		}
+	}
+	return statuses
+}
+
+// firstFailedCopy returns the index and error of the first failed copy, or
+// -1 and nil if no copy failed.
+func firstFailedCopy(statuses []CopyStatus) (int, error) {
+	for i, status := range statuses {
+		if status.State == CopyFailed {
+			return i, status.Err
+		}
+	}
+	return -1, nil
+}
+
+// copiesFinished returns true if every copy either succeeded or was skipped.
+func copiesFinished(statuses []CopyStatus) bool {
+	for _, status := range statuses {
+		if status.State != CopySucceeded && status.State != CopySkipped {
+			return false
+		}
+	}
+	return true
+}
+
+// skippedCopies returns the source images of skipped jobs.
+func skippedCopies(jobs []CopyJob, statuses []CopyStatus) map[string]error {
+	skipped := make(map[string]error)
+	for i, status := range statuses {
+		if status.State == CopySkipped {
+			skipped[jobs[i].SrcImage] = status.Err
+		}
+	}
+	return skipped
+}
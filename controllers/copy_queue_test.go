@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+type countingRegistryManager struct {
+	mu     sync.Mutex
+	copies map[string]int
+	err    error
+	size   int64
+}
+
+func (c *countingRegistryManager) ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error) {
+	return c.size, nil
+}
+
+func (c *countingRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstRegistryCredentials *RegistryCredentials) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copies[srcImage]++
+	return c.err
+}
+
+func TestCopyQueueDeduplicatesJobs(t *testing.T) {
+
+	registryManager := &countingRegistryManager{copies: map[string]int{}}
+	queue := NewCopyQueue(registryManager, 2)
+	events := make(chan event.GenericEvent, 2)
+
+	job := CopyJob{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0]}
+	deployment1 := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	deployment2 := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d2", Namespace: "ns"}}
+
+	assert.Equal(t, CopyPending, queue.Enqueue(job, events, deployment1).State)
+	assert.Equal(t, CopyPending, queue.Enqueue(job, events, deployment2).State)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+
+	var woken []string
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			woken = append(woken, e.Object.GetName())
+		case <-time.After(time.Second * 5):
+			t.Fatal("workload was not notified")
+		}
+	}
+	assert.ElementsMatch(t, []string{"d1", "d2"}, woken)
+	assert.Equal(t, 1, registryManager.copies[SrcImageNames[0]])
+	assert.Equal(t, CopySucceeded, queue.Enqueue(job, events, deployment1).State)
+}
+
+func TestCopyQueuePrunesExpiredResults(t *testing.T) {
+
+	queue := NewCopyQueue(&countingRegistryManager{copies: map[string]int{}}, 1)
+	queue.ResultTTL = time.Millisecond * 10
+	events := make(chan event.GenericEvent, 2)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	job := CopyJob{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0]}
+
+	queue.Enqueue(job, events, deployment)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	<-events
+
+	// the result of a job nobody asks for again is dropped by later enqueues
+	time.Sleep(queue.ResultTTL * 2)
+	other := CopyJob{SrcImage: SrcImageNames[1], DstImage: DstImageNames[1]}
+	queue.Enqueue(other, events, deployment)
+
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	_, ok := queue.tasks[job.key()]
+	assert.False(t, ok)
+	_, ok = queue.tasks[other.key()]
+	assert.True(t, ok)
+}
+
+func TestCopyQueueSeparatesCredentials(t *testing.T) {
+
+	registryManager := &countingRegistryManager{copies: map[string]int{}}
+	queue := NewCopyQueue(registryManager, 1)
+	events := make(chan event.GenericEvent, 2)
+	deployment1 := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	deployment2 := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d2", Namespace: "ns"}}
+
+	// a workload with a wrong pull secret doesn't decide the result of another one
+	job := CopyJob{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0], SrcCredentials: &RegistryCredentials{Username: "user", Password: "wrong"}}
+	other := job
+	other.SrcCredentials = &RegistryCredentials{Username: "user", Password: "right"}
+	assert.NotEqual(t, job.key(), other.key())
+	assert.NotContains(t, job.key(), "wrong")
+
+	queue.Enqueue(job, events, deployment1)
+	queue.Enqueue(other, events, deployment2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	<-events
+	<-events
+	assert.Equal(t, 2, registryManager.copies[SrcImageNames[0]])
+}
+
+func TestQueueImageCopiesForgetsTransientFailures(t *testing.T) {
+
+	registryManager := &countingRegistryManager{copies: map[string]int{}, err: errors.New("connection reset by peer")}
+	queue := NewCopyQueue(registryManager, 1)
+	events := make(chan event.GenericEvent, 1)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	jobs := []CopyJob{{SrcImage: SrcImageNames[1], DstImage: DstImageNames[1]}}
+
+	statuses := queueImageCopies(queue, events, deployment, jobs)
+	assert.False(t, copiesFinished(statuses))
+	_, err := firstFailedCopy(statuses)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	<-events
+
+	statuses = queueImageCopies(queue, events, deployment, jobs)
+	i, err := firstFailedCopy(statuses)
+	assert.Error(t, err)
+	assert.Equal(t, 0, i)
+
+	// the failure was forgotten, so the next reconcile copies again
+	assert.Equal(t, CopyPending, queue.Enqueue(jobs[0], events, deployment).State)
+}
+
+type blockingRegistryManager struct {
+	started chan struct{}
+}
+
+func (b *blockingRegistryManager) ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error) {
+	return 0, nil
+}
+
+func (b *blockingRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstRegistryCredentials *RegistryCredentials) error {
+	close(b.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCopyQueueCancelsCopiesOnShutdown(t *testing.T) {
+
+	registryManager := &blockingRegistryManager{started: make(chan struct{})}
+	queue := NewCopyQueue(registryManager, 1)
+	queue.ShutdownTimeout = time.Millisecond * 50
+	events := make(chan event.GenericEvent)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+
+	queue.Enqueue(CopyJob{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0]}, events, deployment)
+	queue.Enqueue(CopyJob{SrcImage: SrcImageNames[1], DstImage: DstImageNames[1]}, events, deployment)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		assert.NoError(t, queue.Start(ctx))
+	}()
+
+	<-registryManager.started
+	cancel()
+
+	// the running copy is cancelled after the shutdown timeout and the queued
+	// one is never started
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("copy queue did not stop")
+	}
+}
+
+func TestCopyQueueTimeout(t *testing.T) {
+
+	registryManager := &blockingRegistryManager{started: make(chan struct{})}
+	queue := NewCopyQueue(registryManager, 1)
+	queue.CopyTimeout = time.Millisecond * 50
+	events := make(chan event.GenericEvent, 1)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	job := CopyJob{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0]}
+
+	queue.Enqueue(job, events, deployment)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+
+	select {
+	case <-events:
+	case <-time.After(time.Second * 5):
+		t.Fatal("copy did not time out")
+	}
+	status := queue.Enqueue(job, events, deployment)
+	assert.Equal(t, CopyFailed, status.State)
+	assert.ErrorIs(t, status.Err, context.DeadlineExceeded)
+}
+
+func TestCopyQueueSkipsLargeImages(t *testing.T) {
+
+	registryManager := &countingRegistryManager{copies: map[string]int{}, size: 2048}
+	queue := NewCopyQueue(registryManager, 1)
+	events := make(chan event.GenericEvent, 2)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	jobs := []CopyJob{
+		{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0], MaxSize: 1024},
+		{SrcImage: SrcImageNames[1], DstImage: DstImageNames[1], MaxSize: 4096},
+	}
+
+	queueImageCopies(queue, events, deployment, jobs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	<-events
+	<-events
+
+	statuses := queueImageCopies(queue, events, deployment, jobs)
+	assert.True(t, copiesFinished(statuses))
+	skipped := skippedCopies(jobs, statuses)
+	assert.Len(t, skipped, 1)
+	assert.IsType(t, &ImageTooLargeError{}, skipped[SrcImageNames[0]])
+	assert.Equal(t, 0, registryManager.copies[SrcImageNames[0]])
+	assert.Equal(t, 1, registryManager.copies[SrcImageNames[1]])
+}
+
+func TestMaxImageSize(t *testing.T) {
+
+	deployment := &appsv1.Deployment{}
+	maxSize, err := maxImageSize(deployment, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), maxSize)
+
+	deployment.Annotations = map[string]string{MAX_IMAGE_SIZE_ANNOTATION: "512"}
+	maxSize, err = maxImageSize(deployment, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(512), maxSize)
+
+	// the annotation can't raise the global limit
+	deployment.Annotations[MAX_IMAGE_SIZE_ANNOTATION] = "1Gi"
+	maxSize, err = maxImageSize(deployment, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), maxSize)
+
+	maxSize, err = maxImageSize(deployment, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<30), maxSize)
+
+	deployment.Annotations[MAX_IMAGE_SIZE_ANNOTATION] = "huge"
+	_, err = maxImageSize(deployment, 0)
+	assert.Error(t, err)
+}
+
+// pushingRegistryManager only accepts pushes with password.
+type pushingRegistryManager struct {
+	countingRegistryManager
+	password string
+}
+
+func (p *pushingRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstRegistryCredentials *RegistryCredentials) error {
+	_ = p.countingRegistryManager.CopyImage(ctx, srcImage, dstImage, srcRegistryCredentials, dstRegistryCredentials)
+	if dstRegistryCredentials.Password != p.password {
+		return classifyCopyError(errcode.ErrorCodeUnauthorized)
+	}
+	return nil
+}
+
+func TestCopyQueueRetriesRejectedCopiesWithReloadedCredentials(t *testing.T) {
+
+	registryManager := &pushingRegistryManager{countingRegistryManager: countingRegistryManager{copies: map[string]int{}}, password: "new-password"}
+	queue := NewCopyQueue(registryManager, 1)
+	queue.BackupCredentials = NewBackupCredentials(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "old-password"})
+	events := make(chan event.GenericEvent, 1)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	job := CopyJob{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0], DstCredentials: queue.BackupCredentials.Get()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	queue.Enqueue(job, events, deployment)
+	<-events
+	status := queue.Enqueue(job, events, deployment)
+	assert.Equal(t, CopyFailed, status.State)
+	assert.True(t, IsPermanentError(status.Err))
+
+	// the rejected copy is retried with the reloaded credentials, although
+	// the job was queued with the old ones
+	queue.BackupCredentials.Set(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "new-password"})
+	select {
+	case e := <-events:
+		assert.Equal(t, "d1", e.Object.GetName())
+	case <-time.After(time.Second * 5):
+		t.Fatal("workload was not notified")
+	}
+	assert.Equal(t, CopyPending, queue.Enqueue(job, events, deployment).State)
+	<-events
+	assert.Equal(t, CopySucceeded, queue.Enqueue(job, events, deployment).State)
+	assert.Equal(t, 2, registryManager.copies[SrcImageNames[0]])
+}
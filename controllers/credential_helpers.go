@@ -0,0 +1,351 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"golang.org/x/sync/singleflight"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DEFAULT_CREDENTIAL_CACHE_DURATION is how long credentials of a docker
+	// credential helper are used, the helpers don't report an expiry.
+	DEFAULT_CREDENTIAL_CACHE_DURATION = time.Minute * 5
+	DEFAULT_CREDENTIAL_HELPER_TIMEOUT = time.Minute
+
+	DEFAULT_CREDENTIAL_PROVIDER_API_VERSION = "credentialprovider.kubelet.k8s.io/v1alpha1"
+
+	dockerHubServerURL = "https://index.docker.io/v1/"
+)
+
+// CredentialsConfig obtains the credentials of a registry from an external
+// program at copy time, e.g. for registries with short-lived tokens. Exactly
+// one of Helper and Provider is set.
+type CredentialsConfig struct {
+	// Helper is the name of a docker credential helper, "ecr-login" runs
+	// docker-credential-ecr-login.
+	Helper string `json:"helper,omitempty"`
+	// Provider is a kubelet credential provider plugin.
+	Provider *CredentialProviderConfig `json:"provider,omitempty"`
+}
+
+type CredentialProviderConfig struct {
+	Command    string   `json:"command"`
+	Args       []string `json:"args,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	APIVersion string   `json:"apiVersion,omitempty"`
+	// DefaultCacheDuration is used if the response has no cacheDuration.
+	DefaultCacheDuration *metav1.Duration `json:"defaultCacheDuration,omitempty"`
+}
+
+func (c *CredentialsConfig) validate() error {
+	if (c.Helper == "") == (c.Provider == nil) {
+		return errors.New("exactly one of helper and provider must be set")
+	}
+	if c.Provider != nil && c.Provider.Command == "" {
+		return errors.New("provider.command must be set")
+	}
+	return nil
+}
+
+// credentialProviderRequest and credentialProviderResponse are the
+// CredentialProviderRequest and CredentialProviderResponse of the kubelet
+// credential provider API.
+type credentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type credentialProviderResponse struct {
+	CacheKeyType  string                    `json:"cacheKeyType"`
+	CacheDuration *metav1.Duration          `json:"cacheDuration,omitempty"`
+	Auth          map[string]authCredential `json:"auth,omitempty"`
+}
+
+type authCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// dockerHelperCredentials is the output of "docker-credential-<helper> get".
+type dockerHelperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+type cachedCredentials struct {
+	credentials *RegistryCredentials
+	expires     time.Time
+}
+
+// CredentialHelpers runs the credential helpers configured per registry host
+// and caches their credentials until they expire. Concurrent lookups of the
+// same credentials share one run of the helper.
+type CredentialHelpers struct {
+	config *RegistryConfig
+
+	mu    sync.Mutex
+	cache map[string]cachedCredentials
+	runs  singleflight.Group
+
+	// run executes a helper program, stdin is written to its standard input.
+	run func(ctx context.Context, command string, args, env []string, stdin []byte) ([]byte, error)
+}
+
+func NewCredentialHelpers(config *RegistryConfig) *CredentialHelpers {
+	return &CredentialHelpers{
+		config: config,
+		cache:  make(map[string]cachedCredentials),
+		run:    runCredentialHelper,
+	}
+}
+
+// Get returns the credentials of host for pulling or pushing image, or nil if
+// no credential helper is configured for host.
+func (h *CredentialHelpers) Get(ctx context.Context, host, image string) (*RegistryCredentials, error) {
+	if h == nil {
+		return nil, nil
+	}
+	host = normalizeRegistryHost(host)
+	credentialsConfig := h.config.hostConfig(host).Credentials
+	if credentialsConfig == nil {
+		return nil, nil
+	}
+
+	if credentials, ok := h.cached(host, image); ok {
+		return credentials, nil
+	}
+
+	// docker credential helpers return the credentials of the host, providers
+	// may return credentials of the image
+	runKey := host
+	if credentialsConfig.Provider != nil {
+		runKey = host + "/" + image
+	}
+	// the run is shared, so it doesn't end with the copy that started it.
+	// fetch bounds it with DEFAULT_CREDENTIAL_HELPER_TIMEOUT.
+	run := h.runs.DoChan(runKey, func() (interface{}, error) {
+		// the credentials may have been cached while waiting
+		if credentials, ok := h.cached(host, image); ok {
+			return credentials, nil
+		}
+		return h.fetch(context.Background(), credentialsConfig, host, image)
+	})
+	select {
+	case result := <-run:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*RegistryCredentials), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// cached returns the unexpired cached credentials of image or host.
+func (h *CredentialHelpers) cached(host, image string) (*RegistryCredentials, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range []string{host + "/" + image, host} {
+		if cached, ok := h.cache[key]; ok && time.Now().Before(cached.expires) {
+			return cached.credentials, true
+		}
+	}
+	return nil, false
+}
+
+// fetch runs the credential helper or provider of host and caches the
+// credentials it returns.
+func (h *CredentialHelpers) fetch(ctx context.Context, credentialsConfig *CredentialsConfig, host, image string) (*RegistryCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, DEFAULT_CREDENTIAL_HELPER_TIMEOUT)
+	defer cancel()
+
+	var credentials *RegistryCredentials
+	var cacheKey string
+	var cacheDuration time.Duration
+	var err error
+	if credentialsConfig.Helper != "" {
+		credentials, err = h.dockerHelperCredentials(ctx, credentialsConfig.Helper, host)
+		cacheKey, cacheDuration = host, DEFAULT_CREDENTIAL_CACHE_DURATION
+	} else {
+		credentials, cacheKey, cacheDuration, err = h.providerCredentials(ctx, credentialsConfig.Provider, host, image)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials for %s: %w", host, err)
+	}
+
+	if cacheDuration > 0 {
+		h.mu.Lock()
+		h.cache[cacheKey] = cachedCredentials{credentials: credentials, expires: time.Now().Add(cacheDuration)}
+		h.mu.Unlock()
+	}
+	return credentials, nil
+}
+
+// resolve returns the credentials of host from its credential helper, or
+// credentials if host has none.
+func (h *CredentialHelpers) resolve(ctx context.Context, host, image string, credentials *RegistryCredentials) (*RegistryCredentials, error) {
+	helperCredentials, err := h.Get(ctx, host, image)
+	if err != nil || helperCredentials == nil {
+		return credentials, err
+	}
+	return helperCredentials, nil
+}
+
+// invalidate drops the cached credentials of hosts, e.g. after the registry
+// rejected them. It returns true if any of the hosts uses a credential helper.
+func (h *CredentialHelpers) invalidate(hosts ...string) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	found := false
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		host = normalizeRegistryHost(host)
+		if h.config.hostConfig(host).Credentials == nil {
+			continue
+		}
+		found = true
+		for key := range h.cache {
+			if key == host || strings.HasPrefix(key, host+"/") {
+				delete(h.cache, key)
+			}
+		}
+	}
+	return found
+}
+
+func (h *CredentialHelpers) dockerHelperCredentials(ctx context.Context, helper, host string) (*RegistryCredentials, error) {
+	serverURL := host
+	if host == "docker.io" {
+		serverURL = dockerHubServerURL
+	}
+
+	out, err := h.run(ctx, "docker-credential-"+helper, []string{"get"}, nil, []byte(serverURL))
+	if err != nil {
+		return nil, err
+	}
+	helperCredentials := dockerHelperCredentials{}
+	if err := json.Unmarshal(out, &helperCredentials); err != nil {
+		return nil, fmt.Errorf("invalid output of credential helper %s: %v", helper, err)
+	}
+	if helperCredentials.Username == "<token>" {
+		return &RegistryCredentials{URL: host, IdentityToken: helperCredentials.Secret}, nil
+	}
+	return &RegistryCredentials{
+		URL:      host,
+		Username: helperCredentials.Username,
+		Password: helperCredentials.Secret,
+	}, nil
+}
+
+func (h *CredentialHelpers) providerCredentials(ctx context.Context, provider *CredentialProviderConfig, host, image string) (*RegistryCredentials, string, time.Duration, error) {
+	apiVersion := provider.APIVersion
+	if apiVersion == "" {
+		apiVersion = DEFAULT_CREDENTIAL_PROVIDER_API_VERSION
+	}
+	request, err := json.Marshal(credentialProviderRequest{
+		APIVersion: apiVersion,
+		Kind:       "CredentialProviderRequest",
+		Image:      image,
+	})
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	out, err := h.run(ctx, provider.Command, provider.Args, provider.Env, request)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	response := credentialProviderResponse{}
+	if err := json.Unmarshal(out, &response); err != nil {
+		return nil, "", 0, fmt.Errorf("invalid response of credential provider %s: %v", provider.Command, err)
+	}
+
+	var credentials *RegistryCredentials
+	for pattern, auth := range response.Auth {
+		if matchRegistryPattern(pattern, host) {
+			credentials = &RegistryCredentials{URL: host, Username: auth.Username, Password: auth.Password}
+			break
+		}
+	}
+	if credentials == nil {
+		return nil, "", 0, fmt.Errorf("credential provider %s returned no credentials for %s", provider.Command, host)
+	}
+
+	cacheDuration := DEFAULT_CREDENTIAL_CACHE_DURATION
+	if provider.DefaultCacheDuration != nil {
+		cacheDuration = provider.DefaultCacheDuration.Duration
+	}
+	if response.CacheDuration != nil {
+		cacheDuration = response.CacheDuration.Duration
+	}
+	cacheKey := host
+	if response.CacheKeyType == "Image" {
+		cacheKey = host + "/" + image
+	}
+	return credentials, cacheKey, cacheDuration, nil
+}
+
+// matchRegistryPattern reports whether host matches a key of the auth map of a
+// credential provider response, e.g. "*.dkr.ecr.*.amazonaws.com". Globs match
+// a single domain component like in the kubelet.
+func matchRegistryPattern(pattern, host string) bool {
+	return newKeyringEntry(pattern).matchesHost(host)
+}
+
+func runCredentialHelper(ctx context.Context, command string, args, env []string, stdin []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// expiredCredentialsError is returned when a registry rejected credentials of
+// a credential helper. They are fetched again on the next attempt.
+type expiredCredentialsError struct {
+	err error
+}
+
+func (e *expiredCredentialsError) Error() string {
+	return "credentials expired: " + e.err.Error()
+}
+
+func (e *expiredCredentialsError) Unwrap() error {
+	return e.err
+}
+
+func isUnauthorizedError(err error) bool {
+	if isDockerUnauthorizedError(err) {
+		return true
+	}
+	if code, ok := registryErrorCode(err); ok && code == errcode.ErrorCodeUnauthorized {
+		return true
+	}
+	return httpStatusCode(err) == http.StatusUnauthorized
+}
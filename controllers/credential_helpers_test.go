@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialHelpers(t *testing.T) {
+
+	helpers := NewCredentialHelpers(&RegistryConfig{
+		Registries: map[string]RegistryHostConfig{
+			"docker.io": {Credentials: &CredentialsConfig{Helper: "test"}},
+			"123.dkr.ecr.us-east-1.amazonaws.com": {Credentials: &CredentialsConfig{Provider: &CredentialProviderConfig{
+				Command: "ecr-credential-provider",
+			}}},
+		},
+	})
+
+	var runs []string
+	helpers.run = func(ctx context.Context, command string, args, env []string, stdin []byte) ([]byte, error) {
+		runs = append(runs, command)
+		if command == "docker-credential-test" {
+			assert.Equal(t, []string{"get"}, args)
+			assert.Equal(t, dockerHubServerURL, string(stdin))
+			return []byte(`{"ServerURL":"https://index.docker.io/v1/","Username":"user","Secret":"token"}`), nil
+		}
+
+		request := credentialProviderRequest{}
+		assert.NoError(t, json.Unmarshal(stdin, &request))
+		assert.Equal(t, "CredentialProviderRequest", request.Kind)
+		assert.Equal(t, "123.dkr.ecr.us-east-1.amazonaws.com/app:v1", request.Image)
+		return []byte(`{"kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"1h",
+			"auth":{"*.dkr.ecr.*.amazonaws.com":{"username":"AWS","password":"ecr-token"}}}`), nil
+	}
+
+	ctx := context.Background()
+
+	credentials, err := helpers.Get(ctx, "index.docker.io", "nginx")
+	assert.NoError(t, err)
+	assert.Equal(t, &RegistryCredentials{URL: "docker.io", Username: "user", Password: "token"}, credentials)
+
+	credentials, err = helpers.Get(ctx, "123.dkr.ecr.us-east-1.amazonaws.com", "123.dkr.ecr.us-east-1.amazonaws.com/app:v1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ecr-token", credentials.Password)
+
+	// hosts without a helper keep their static credentials
+	credentials, err = helpers.Get(ctx, "quay.io", "quay.io/app")
+	assert.NoError(t, err)
+	assert.Nil(t, credentials)
+
+	// cached until invalidated
+	_, _ = helpers.Get(ctx, "docker.io", "nginx")
+	assert.Len(t, runs, 2)
+	assert.True(t, helpers.invalidate("docker.io"))
+	assert.False(t, helpers.invalidate("quay.io"))
+	_, _ = helpers.Get(ctx, "docker.io", "nginx")
+	assert.Len(t, runs, 3)
+
+	// rejected helper credentials are retried
+	err = classifyCopyError(&expiredCredentialsError{err: errcode.ErrorCodeUnauthorized})
+	assert.False(t, IsPermanentError(err))
+	assert.True(t, isUnauthorizedError(errcode.ErrorCodeUnauthorized.WithMessage("denied")))
+}
+
+func TestCredentialHelperIdentityToken(t *testing.T) {
+
+	helpers := NewCredentialHelpers(&RegistryConfig{
+		Registries: map[string]RegistryHostConfig{
+			"myregistry.azurecr.io": {Credentials: &CredentialsConfig{Helper: "acr-env"}},
+		},
+	})
+	helpers.run = func(ctx context.Context, command string, args, env []string, stdin []byte) ([]byte, error) {
+		return []byte(`{"ServerURL":"myregistry.azurecr.io","Username":"<token>","Secret":"refresh-token"}`), nil
+	}
+
+	credentials, err := helpers.Get(context.Background(), "myregistry.azurecr.io", "myregistry.azurecr.io/app:v1")
+	assert.NoError(t, err)
+	assert.Equal(t, &RegistryCredentials{URL: "myregistry.azurecr.io", IdentityToken: "refresh-token"}, credentials)
+}
+
+func TestMatchRegistryPattern(t *testing.T) {
+
+	assert.True(t, matchRegistryPattern("*.dkr.ecr.*.amazonaws.com", "123.dkr.ecr.us-east-1.amazonaws.com"))
+	assert.True(t, matchRegistryPattern("https://gcr.io", "gcr.io"))
+	assert.True(t, matchRegistryPattern("*.gcr.io", "eu.gcr.io"))
+	assert.False(t, matchRegistryPattern("*.gcr.io", "gcr.io"))
+	assert.False(t, matchRegistryPattern("*.dkr.ecr.*.amazonaws.com", "quay.io"))
+}
+
+func TestCredentialHelpersConcurrentLookups(t *testing.T) {
+
+	helpers := NewCredentialHelpers(&RegistryConfig{
+		Registries: map[string]RegistryHostConfig{
+			"slow.io": {Credentials: &CredentialsConfig{Helper: "slow"}},
+			"fast.io": {Credentials: &CredentialsConfig{Helper: "fast"}},
+		},
+	})
+	release := make(chan struct{})
+	var runs int32
+	helpers.run = func(ctx context.Context, command string, args, env []string, stdin []byte) ([]byte, error) {
+		if command == "docker-credential-slow" {
+			atomic.AddInt32(&runs, 1)
+			<-release
+		}
+		return []byte(`{"Username":"user","Secret":"token"}`), nil
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			credentials, err := helpers.Get(ctx, "slow.io", "slow.io/app")
+			assert.NoError(t, err)
+			assert.Equal(t, "token", credentials.Password)
+		}()
+	}
+
+	// lookups of other hosts don't wait for the running helper
+	credentials, err := helpers.Get(ctx, "fast.io", "fast.io/app")
+	assert.NoError(t, err)
+	assert.Equal(t, "token", credentials.Password)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+}
+
+func TestCredentialHelpersCancelledLookup(t *testing.T) {
+
+	helpers := NewCredentialHelpers(&RegistryConfig{
+		Registries: map[string]RegistryHostConfig{
+			"slow.io": {Credentials: &CredentialsConfig{Helper: "slow"}},
+		},
+	})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	helpers.run = func(ctx context.Context, command string, args, env []string, stdin []byte) ([]byte, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return []byte(`{"Username":"user","Secret":"token"}`), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() {
+		_, err := helpers.Get(ctx, "slow.io", "slow.io/app")
+		cancelled <- err
+	}()
+	<-started
+
+	waiting := make(chan error)
+	go func() {
+		credentials, err := helpers.Get(context.Background(), "slow.io", "slow.io/app")
+		if err == nil && credentials.Password != "token" {
+			err = errors.New("unexpected credentials")
+		}
+		waiting <- err
+	}()
+
+	// the caller that started the helper gives up, the others keep waiting
+	cancel()
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+	close(release)
+	assert.NoError(t, <-waiting)
+}
@@ -22,28 +22,49 @@ import (
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/record"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // DeploymentImageBackupReconciler reconciles a ImageBackup object
 type DeploymentImageBackupReconciler struct {
 	client.Client
 	Scheme                    *runtime.Scheme
-	RegistryManager           RegistryManager
-	BackUpRegistryCredentials *RegistryCredentials
+	CopyQueue                 *CopyQueue
+	BackUpRegistryCredentials *BackupCredentials
 	IgnoreNamespaces          []string
+	RetryPolicy               RetryPolicy
+	MaxImageSize              int64
+	Recorder                  record.EventRecorder
+	ReportStatus              bool
+	ProgressInterval          time.Duration
+	// Destinations are replicated to besides the backup registry, BackupPolicy
+	// decides which copies must succeed.
+	Destinations []BackupDestination
+	BackupPolicy BackupPolicy
+	// PullCredentials, if set, are distributed to the namespaces instead of
+	// the push credentials.
+	PullCredentials *PullCredentials
+
+	copyEvents chan event.GenericEvent
 }
 
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=apps,resources=deployments/finalizers,verbs=update
 //+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -73,87 +94,174 @@ func (r *DeploymentImageBackupReconciler) Reconcile(ctx context.Context, req ctr
 	for _, container := range deployment.Spec.Template.Spec.Containers {
 		lg.Info("Image", "namespace", deployment.Namespace, "name", deployment.Name, "image", container.Image)
 	}
+	// the credentials may be reloaded, use the same ones for the whole reconcile
+	backupCredentials := r.BackUpRegistryCredentials.Get()
+
 	var srcImages []string
 	var dstImages []string
 
 	// get src and dst image name list
 	for _, container := range deployment.Spec.Template.Spec.Containers {
 		srcImages = append(srcImages, container.Image)
-		dstImages = append(dstImages, getDestinationImageName(container.Image, r.BackUpRegistryCredentials.URL, r.BackUpRegistryCredentials.Username))
+		dstImages = append(dstImages, getDestinationImageName(container.Image, backupCredentials.URL, backupCredentials.Username))
 	}
 
-	// get registry credentials from ImagePullSecrets
-	srcRegistryCredentials, err := getRegistryCredentials(ctx, r.Client, deployment.Spec.Template.Spec.ImagePullSecrets, deployment.Namespace)
+	// get registry credentials from ImagePullSecrets and the ServiceAccount
+	srcRegistryCredentials, invalidSecrets, err := getRegistryCredentials(ctx, r.Client, &deployment.Spec.Template.Spec, deployment.Namespace)
 	if err != nil {
 		lg.Error(err, "failed to get registry credentials")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+		return ctrl.Result{Requeue: true}, nil
+	}
+	for _, err := range invalidSecrets {
+		lg.Error(err, "ignoring invalid registry secret")
+		r.Recorder.Event(deployment, corev1.EventTypeWarning, EVENT_REASON_INVALID_CONFIG, err.Error())
 	}
 
-	lg.Info("src", "creds", srcRegistryCredentials)
+	lg.Info("src", "registries", srcRegistryCredentials.registries())
 
-	// create destination registry secret
-	dstRegistryDockerSecret, err := getDockerConfigSecret(r.BackUpRegistryCredentials.Username, r.BackUpRegistryCredentials.Password, r.BackUpRegistryCredentials.URL)
+	// destination registry secret, created once the images are backed up
+	dstRegistryDockerSecret, err := getDestinationSecret(ctx, r.Client, r.PullCredentials, backupCredentials, deployment.Namespace)
 	if err != nil {
 		lg.Error(err, "failed to get docker config secret")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
-	}
-	if dstRegistryDockerSecret != nil {
-		dstRegistryDockerSecret.Namespace = deployment.Namespace
-		err = createRegistrySecret(ctx, r.Client, dstRegistryDockerSecret)
-		if err != nil {
-			lg.Error(err, "failed to create registry secret")
-			return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+		if IsPermanentError(err) {
+			r.Recorder.Event(deployment, corev1.EventTypeWarning, EVENT_REASON_INVALID_CONFIG, err.Error())
+			return ctrl.Result{}, nil
 		}
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	maxSize, err := maxImageSize(deployment, r.MaxImageSize)
+	if err != nil {
+		lg.Error(err, "invalid image size limit")
+		r.Recorder.Event(deployment, corev1.EventTypeWarning, EVENT_REASON_INVALID_CONFIG, err.Error())
+		return ctrl.Result{}, nil
 	}
 
-	// copy images from src to dst.
-	// TODO improvement. make image copy concurrent for multiple images (using go routines)
+	// queue copies of the images from src to dst. The workload is reconciled
+	// again once the copies finished.
+	var copyJobs []CopyJob
 	for i, container := range deployment.Spec.Template.Spec.Containers {
-		if strings.Contains(container.Image, r.BackUpRegistryCredentials.URL) {
+		if strings.Contains(container.Image, backupCredentials.URL) {
 			continue
 		}
-		srcRegistryURL := strings.Split(container.Image, "/")[0]
-		if true {
-			srcRegistryCredential := &RegistryCredentials{}
+		srcRegistryCredential := srcRegistryCredentials.lookup(container.Image)
+		if srcRegistryCredential == nil {
+			srcRegistryCredential = &RegistryCredentials{}
+		}
+		copyJob := CopyJob{
+			SrcImage:       srcImages[i],
+			DstImage:       dstImages[i],
+			SrcCredentials: srcRegistryCredential,
+			DstCredentials: backupCredentials,
+			MaxSize:        maxSize,
+		}
+		copyJobs = append(copyJobs, copyJob)
+		copyJobs = append(copyJobs, replicaCopyJobs(copyJob, r.Destinations)...)
+	}
 
-			if len(srcRegistryCredentials) != 0 {
-				if _, ok := srcRegistryCredentials[srcRegistryURL]; !ok {
-					srcRegistryURL = DEFAULT_DOCKER_REGISTRY
-				}
-				srcRegistryCredential = srcRegistryCredentials[srcRegistryURL]
-			}
-			err := r.RegistryManager.CopyImage(ctx, srcImages[i], dstImages[i], srcRegistryCredential, r.BackUpRegistryCredentials)
-			if err != nil {
-				lg.Error(err, "failed to copy image")
-				return ctrl.Result{RequeueAfter: time.Second * 10}, nil
-			}
+	copyStatuses := queueImageCopies(r.CopyQueue, r.copyEvents, deployment, copyJobs)
+	imageJobs, imageStatuses := imageBackupStatuses(r.BackupPolicy, copyJobs, copyStatuses)
+	if i, err := firstFailedCopy(imageStatuses); err != nil {
+		lg.Error(err, "failed to copy image", "image", imageJobs[i].SrcImage, "permanent", IsPermanentError(err))
+		r.reportStatus(ctx, deployment, newBackupStatus(copyJobs, copyStatuses))
+		return copyFailureResult(r.Recorder, deployment, imageJobs[i].SrcImage, err), nil
+	}
+	if !copiesFinished(imageStatuses) {
+		lg.Info("waiting for images to be copied")
+		if r.ReportStatus {
+			r.reportStatus(ctx, deployment, newBackupStatus(copyJobs, copyStatuses))
+			return ctrl.Result{RequeueAfter: r.ProgressInterval}, nil
 		}
+		return ctrl.Result{}, nil
 	}
 
-	// update image name in deployment
+	// the CopyQueue scanned the backup images before the deployment is rewritten to them
+	scanResults, err := copyScanResults(copyJobs, copyStatuses)
+	if err != nil {
+		lg.Error(err, "failed to scan images")
+		r.Recorder.Event(deployment, corev1.EventTypeWarning, EVENT_REASON_SCAN_ERROR, err.Error())
+		r.reportStatus(ctx, deployment, newBackupStatus(copyJobs, copyStatuses).setScanResults(scanResults))
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	// update image name in deployment, skipped and rejected images keep pointing to their source
+	recordFailedReplicaCopies(r.Recorder, deployment, copyJobs, copyStatuses)
+	skippedImages := recordSkippedCopies(r.Recorder, deployment, imageJobs, imageStatuses)
+	rejectedImages := recordScanResults(r.Recorder, deployment, imageJobs, scanResults)
+	backedUp := false
 	for i := range deployment.Spec.Template.Spec.Containers {
-		if true {
+		_, skipped := skippedImages[srcImages[i]]
+		_, rejected := rejectedImages[srcImages[i]]
+		if !skipped && !rejected {
 			deployment.Spec.Template.Spec.Containers[i].Image = dstImages[i]
 		}
+		if strings.Contains(deployment.Spec.Template.Spec.Containers[i].Image, backupCredentials.URL) {
+			backedUp = true
+		}
 	}
 
+	// keep the existing pull secrets, the backup registry's is only needed
+	// while images point to it. With ServiceAccounts the pods get it from
+	// their ServiceAccount. It is created right before the update, so it
+	// isn't collected as unreferenced while the copies run.
 	if dstRegistryDockerSecret != nil {
-		deployment.Spec.Template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: dstRegistryDockerSecret.Name}}
+		if backedUp {
+			err = createRegistrySecret(ctx, r.Client, dstRegistryDockerSecret)
+			if err != nil {
+				lg.Error(err, "failed to create registry secret")
+				if IsPermanentError(err) {
+					r.Recorder.Event(deployment, corev1.EventTypeWarning, EVENT_REASON_INVALID_CONFIG, err.Error())
+					return ctrl.Result{}, nil
+				}
+				return ctrl.Result{Requeue: true}, nil
+			}
+		}
+		switch {
+		case backedUp && r.PullCredentials.serviceAccounts():
+			err = attachPullSecretToServiceAccount(ctx, r.Client, &deployment.Spec.Template.Spec, deployment.Namespace, dstRegistryDockerSecret.Name)
+			if err != nil {
+				lg.Error(err, "failed to attach registry secret to service account")
+				return ctrl.Result{Requeue: true}, nil
+			}
+			removePullSecret(deployment, &deployment.Spec.Template.Spec.ImagePullSecrets)
+		case backedUp:
+			addPullSecret(deployment, &deployment.Spec.Template.Spec.ImagePullSecrets, dstRegistryDockerSecret.Name)
+		default:
+			removePullSecret(deployment, &deployment.Spec.Template.Spec.ImagePullSecrets)
+		}
+	}
+
+	if r.ReportStatus {
+		setBackupStatus(deployment, newBackupStatus(copyJobs, copyStatuses).setScanResults(scanResults))
 	}
 
 	err = r.Client.Update(ctx, deployment)
 	if err != nil {
 		lg.Error(err, "failed to update deployment")
-		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+		return ctrl.Result{Requeue: true}, nil
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// reportStatus writes status to the status annotation of obj if enabled.
+func (r *DeploymentImageBackupReconciler) reportStatus(ctx context.Context, obj client.Object, status *BackupStatus) {
+	if !r.ReportStatus {
+		return
+	}
+	if err := updateBackupStatus(ctx, r.Client, obj, status); err != nil {
+		log.FromContext(ctx).Error(err, "failed to update backup status")
+	}
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *DeploymentImageBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.copyEvents = make(chan event.GenericEvent)
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&appsv1.Deployment{}).
+		Watches(&source.Channel{Source: r.copyEvents}, &handler.EnqueueRequestForObject{}).
 		WithEventFilter(ignorePredicate(r.IgnoreNamespaces)).
+		WithOptions(controller.Options{RateLimiter: r.RetryPolicy.rateLimiter()}).
 		Complete(r)
 }
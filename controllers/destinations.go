@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	PRIMARY_DESTINATION = "primary"
+	ARCHIVE_DESTINATION = "archive"
+
+	ARCHIVE_FORMAT_OCI            = "oci"
+	ARCHIVE_FORMAT_DOCKER_ARCHIVE = "docker-archive"
+)
+
+// BackupPolicy decides when an image counts as backed up if it is replicated
+// to more than one destination.
+type BackupPolicy string
+
+const (
+	// BACKUP_POLICY_ALL requires the copy to every destination to succeed.
+	BACKUP_POLICY_ALL BackupPolicy = "all"
+	// BACKUP_POLICY_ANY requires a single successful copy. Failed copies to
+	// other destinations are only reported.
+	BACKUP_POLICY_ANY BackupPolicy = "any"
+)
+
+// BackupDestination is a place images are replicated to besides the primary
+// backup registry. Workloads are only ever rewritten to the primary registry.
+type BackupDestination struct {
+	Name string
+	// Credentials of the destination registry, its URL and username also name
+	// the backup images.
+	Credentials     *RegistryCredentials
+	RegistryManager RegistryManager
+}
+
+// DestinationConfig is a secondary backup registry in the registry config.
+type DestinationConfig struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	// PasswordFile holds the registry password, e.g. a mounted Secret.
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+// LoadBackupDestinations returns the secondary destinations of config. Their
+// images are copied with registryManager.
+func LoadBackupDestinations(config *RegistryConfig, registryManager RegistryManager) ([]BackupDestination, error) {
+	var destinations []BackupDestination
+	names := map[string]bool{PRIMARY_DESTINATION: true, ARCHIVE_DESTINATION: true}
+	for _, destinationConfig := range config.Destinations {
+		if destinationConfig.Name == "" || destinationConfig.URL == "" {
+			return nil, errors.New("destinations: name and url are required")
+		}
+		if names[destinationConfig.Name] {
+			return nil, fmt.Errorf("destinations: name %s is already used", destinationConfig.Name)
+		}
+		names[destinationConfig.Name] = true
+
+		credentials := &RegistryCredentials{
+			URL:      normalizeRegistryURL(destinationConfig.URL),
+			Username: destinationConfig.Username,
+		}
+		if destinationConfig.PasswordFile != "" {
+			password, err := ioutil.ReadFile(destinationConfig.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("destination %s: failed to read password: %v", destinationConfig.Name, err)
+			}
+			credentials.Password = strings.TrimSpace(string(password))
+		}
+
+		destinations = append(destinations, BackupDestination{
+			Name:            destinationConfig.Name,
+			Credentials:     credentials,
+			RegistryManager: registryManager,
+		})
+	}
+	return destinations, nil
+}
+
+// normalizeRegistryURL strips the scheme and trailing slash of a registry URL,
+// like BACKUP_REGISTRY_URL.
+func normalizeRegistryURL(url string) string {
+	url = strings.TrimPrefix(url, "http://")
+	url = strings.TrimPrefix(url, "https://")
+	return strings.TrimSuffix(url, "/")
+}
+
+// DestinationRegistryManagers returns the registry manager of every
+// destination by name, for CopyQueue.Destinations.
+func DestinationRegistryManagers(destinations []BackupDestination) map[string]RegistryManager {
+	registryManagers := make(map[string]RegistryManager, len(destinations))
+	for _, destination := range destinations {
+		registryManagers[destination.Name] = destination.RegistryManager
+	}
+	return registryManagers
+}
+
+// replicaCopyJobs returns copies of job to every destination. job copies the
+// image to the primary registry.
+func replicaCopyJobs(job CopyJob, destinations []BackupDestination) []CopyJob {
+	jobs := make([]CopyJob, 0, len(destinations))
+	for _, destination := range destinations {
+		replica := job
+		replica.Destination = destination.Name
+		replica.DstImage = getDestinationImageName(job.SrcImage, destination.Credentials.URL, destination.Credentials.Username)
+		replica.DstCredentials = destination.Credentials
+		jobs = append(jobs, replica)
+	}
+	return jobs
+}
+
+// imageBackupStatuses combines the statuses of the copies of every image to
+// all its destinations according to policy. jobs holds the copy to the
+// primary registry of each image followed by its replicas, the result has an
+// entry per primary copy.
+//
+// An image is pending until all its copies finished. If the primary copy
+// didn't succeed but the policy is still met, the image is reported as skipped
+// so the workload keeps its source image.
+func imageBackupStatuses(policy BackupPolicy, jobs []CopyJob, statuses []CopyStatus) (primaryJobs []CopyJob, imageStatuses []CopyStatus) {
+	for start := 0; start < len(jobs); {
+		end := start + 1
+		for end < len(jobs) && jobs[end].Destination != "" {
+			end++
+		}
+		primaryJobs = append(primaryJobs, jobs[start])
+		imageStatuses = append(imageStatuses, combineCopyStatuses(policy, jobs[start:end], statuses[start:end]))
+		start = end
+	}
+	return primaryJobs, imageStatuses
+}
+
+func combineCopyStatuses(policy BackupPolicy, jobs []CopyJob, statuses []CopyStatus) CopyStatus {
+	combined := CopyStatus{State: CopySucceeded}
+	var succeeded []string
+	var failed error
+	for i, status := range statuses {
+		combined.BytesCopied += status.BytesCopied
+		combined.BytesTotal += status.BytesTotal
+		switch status.State {
+		case CopyPending:
+			combined.State = CopyPending
+		case CopySucceeded:
+			succeeded = append(succeeded, jobs[i].destinationName())
+		case CopyFailed:
+			if failed == nil {
+				failed = fmt.Errorf("%s: %w", jobs[i].destinationName(), status.Err)
+			}
+		}
+	}
+
+	switch primary := statuses[0]; {
+	case combined.State == CopyPending:
+	case primary.State == CopySkipped:
+		combined.State, combined.Err = CopySkipped, primary.Err
+	case failed != nil && (policy != BACKUP_POLICY_ANY || len(succeeded) == 0):
+		combined.State, combined.Err = CopyFailed, failed
+	case primary.State != CopySucceeded:
+		combined.State = CopySkipped
+		combined.Err = fmt.Errorf("backed up to %s only, %v", strings.Join(succeeded, ", "), failed)
+	}
+	return combined
+}
+
+// failedReplicaCopies returns the replica copies that failed, keyed by
+// "<image> to <destination>".
+func failedReplicaCopies(jobs []CopyJob, statuses []CopyStatus) map[string]error {
+	failed := make(map[string]error)
+	for i, status := range statuses {
+		if jobs[i].Destination != "" && status.State == CopyFailed {
+			failed[jobs[i].SrcImage+" to "+jobs[i].Destination] = status.Err
+		}
+	}
+	return failed
+}
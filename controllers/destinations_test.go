@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageBackupStatuses(t *testing.T) {
+
+	destinations := []BackupDestination{
+		{Name: "offsite", Credentials: &RegistryCredentials{URL: "offsite.local", Username: "backup"}},
+	}
+	job := CopyJob{SrcImage: "nginx:1.21", DstImage: "backup.local/user/nginx:1.21"}
+	jobs := append([]CopyJob{job}, replicaCopyJobs(job, destinations)...)
+	assert.Equal(t, "offsite.local/backup/nginx:1.21", jobs[1].DstImage)
+	assert.NotEqual(t, jobs[0].key(), jobs[1].key())
+
+	failed := CopyStatus{State: CopyFailed, Err: &PermanentError{Err: errors.New("denied")}}
+	succeeded := CopyStatus{State: CopySucceeded}
+	pending := CopyStatus{State: CopyPending}
+
+	status := func(policy BackupPolicy, statuses ...CopyStatus) CopyStatus {
+		primaryJobs, imageStatuses := imageBackupStatuses(policy, jobs, statuses)
+		assert.Len(t, primaryJobs, 1)
+		return imageStatuses[0]
+	}
+
+	assert.Equal(t, CopySucceeded, status(BACKUP_POLICY_ALL, succeeded, succeeded).State)
+	assert.Equal(t, CopyPending, status(BACKUP_POLICY_ALL, succeeded, pending).State)
+	assert.Equal(t, CopyPending, status(BACKUP_POLICY_ANY, failed, pending).State)
+
+	// all fails on a failed replica, the error names the destination
+	allStatus := status(BACKUP_POLICY_ALL, succeeded, failed)
+	assert.Equal(t, CopyFailed, allStatus.State)
+	assert.Contains(t, allStatus.Err.Error(), "offsite")
+	assert.True(t, IsPermanentError(allStatus.Err))
+
+	// any tolerates the failed replica
+	assert.Equal(t, CopySucceeded, status(BACKUP_POLICY_ANY, succeeded, failed).State)
+	assert.Len(t, failedReplicaCopies(jobs, []CopyStatus{succeeded, failed}), 1)
+
+	// any with only a replica keeps the source image
+	assert.Equal(t, CopySkipped, status(BACKUP_POLICY_ANY, failed, succeeded).State)
+	assert.Equal(t, CopyFailed, status(BACKUP_POLICY_ANY, failed, failed).State)
+}
+
+func TestLoadBackupDestinations(t *testing.T) {
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.NoError(t, ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	destinations, err := LoadBackupDestinations(&RegistryConfig{
+		Destinations: []DestinationConfig{{Name: "offsite", URL: "https://offsite.local/", Username: "backup", PasswordFile: passwordFile}},
+	}, &TestRegistryManager{})
+	assert.NoError(t, err)
+	assert.Len(t, destinations, 1)
+	assert.Equal(t, &RegistryCredentials{URL: "offsite.local", Username: "backup", Password: "secret"}, destinations[0].Credentials)
+
+	_, err = LoadBackupDestinations(&RegistryConfig{
+		Destinations: []DestinationConfig{{Name: PRIMARY_DESTINATION, URL: "offsite.local"}},
+	}, &TestRegistryManager{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,618 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	_ "github.com/docker/distribution/manifest/ocischema"
+	_ "github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/docker/distribution/registry/client/transport"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	REGISTRY_BACKEND_CONTAINERS_IMAGE = "containers-image"
+	REGISTRY_BACKEND_DISTRIBUTION     = "distribution"
+
+	dockerHubEndpoint = "registry-1.docker.io"
+	// registryIdleConnTimeout is how long idle connections to a registry are
+	// kept for the next copy.
+	registryIdleConnTimeout = 90 * time.Second
+)
+
+// DistributionRegistryManager copies images with the pure Go registry client
+// of docker/distribution. It behaves like ContainerRegistryManager: the
+// linux image of the controller's architecture is chosen from manifest lists,
+// blobs already at the destination are skipped, and mirrors, TLS settings,
+// rate limits, credential helpers and retries are honored. Manifest lists
+// pinned by digest are copied with all of their images instead, so the backup
+// has the same digest. Blobs are streamed from the source to the destination
+// without temporary files.
+type DistributionRegistryManager struct {
+	RegistryConfig *RegistryConfig
+	RetryPolicy    RetryPolicy
+	RateLimiter    *RegistryRateLimiter
+	// ProgressInterval is how often the progress of a running copy is logged.
+	ProgressInterval time.Duration
+	// RegistriesConfPath is a registries.conf file whose mirrors are tried
+	// before the source registry itself.
+	RegistriesConfPath string
+	// CredentialHelpers obtains credentials of registries with a credential
+	// helper at copy time.
+	CredentialHelpers *CredentialHelpers
+
+	registriesConfOnce sync.Once
+	registriesConf     *registriesConf
+	registriesConfErr  error
+
+	mu         sync.Mutex
+	transports map[registryTransportKey]*http.Transport
+}
+
+func (d *DistributionRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstCredentials *RegistryCredentials) error {
+
+	lg := log.FromContext(ctx).WithValues("srcImage", srcImage, "dstImage", dstImage)
+	progress := copyProgressFromContext(ctx)
+	progressInterval := d.ProgressInterval
+	if progressInterval <= 0 {
+		progressInterval = DEFAULT_COPY_PROGRESS_INTERVAL
+	}
+
+	srcHost := registryHost(srcImage)
+	dstHost := registryHost(dstImage)
+
+	if _, err := reference.ParseNormalizedNamed(srcImage); err != nil {
+		return permanentErrorf("invalid source name %s: %v", srcImage, err)
+	}
+	dstNamed, err := reference.ParseNormalizedNamed(dstImage)
+	if err != nil {
+		return permanentErrorf("invalid destination name %s: %v", dstImage, err)
+	}
+
+	return d.RetryPolicy.retry(ctx, func() error {
+		if err := d.RateLimiter.waitForCopy(ctx, srcHost, dstHost); err != nil {
+			return err
+		}
+
+		srcCredentials, err := d.CredentialHelpers.resolve(ctx, srcHost, srcImage, srcRegistryCredentials)
+		if err != nil {
+			return err
+		}
+		dstCredentials, err := d.CredentialHelpers.resolve(ctx, dstHost, dstImage, dstCredentials)
+		if err != nil {
+			return err
+		}
+
+		progress.reset()
+		progressEvents := make(chan copyProgressEvent)
+		progressDone := make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			reportCopyProgress(lg, progressEvents, progress, srcHost, progressInterval)
+		}()
+
+		err = d.copy(ctx, srcImage, srcCredentials, dstNamed, dstCredentials, progressEvents)
+		close(progressEvents)
+		<-progressDone
+
+		if err != nil && isUnauthorizedError(err) && d.CredentialHelpers.invalidate(srcHost, dstHost) {
+			return &expiredCredentialsError{err: err}
+		}
+		return err
+	})
+}
+
+func (d *DistributionRegistryManager) ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error) {
+	srcHost := registryHost(srcImage)
+	// inspecting the manifest counts against the quota of the source registry
+	if err := d.RateLimiter.waitForCopy(ctx, srcHost, ""); err != nil {
+		return 0, err
+	}
+	srcCredentials, err := d.CredentialHelpers.resolve(ctx, srcHost, srcImage, srcRegistryCredentials)
+	if err != nil {
+		return 0, err
+	}
+	src, manifest, err := d.sourceManifest(ctx, srcImage, srcCredentials)
+	if err != nil {
+		return 0, classifyCopyError(fmt.Errorf("failed to inspect image %s: %w", srcImage, err))
+	}
+
+	manifests := []distribution.Manifest{manifest}
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		// pinned manifest lists are copied with all of their images
+		if manifests, err = listManifests(ctx, src, list); err != nil {
+			return 0, classifyCopyError(fmt.Errorf("failed to inspect image %s: %w", srcImage, err))
+		}
+	}
+	var size int64
+	for _, manifest := range manifests {
+		for _, descriptor := range manifest.References() {
+			if descriptor.Size > 0 {
+				size += descriptor.Size
+			}
+		}
+	}
+	return size, nil
+}
+
+// copy copies the blobs of the source manifest that are missing at the
+// destination, then pushes the manifest. The images of a manifest list are
+// pushed by digest before the list itself.
+func (d *DistributionRegistryManager) copy(ctx context.Context, srcImage string, srcCredentials *RegistryCredentials, dstNamed reference.Named, dstCredentials *RegistryCredentials, events chan<- copyProgressEvent) error {
+	src, manifest, err := d.sourceManifest(ctx, srcImage, srcCredentials)
+	if err != nil {
+		return err
+	}
+
+	dst, err := d.repository(ctx, dstNamed, false, dstCredentials, "pull", "push")
+	if err != nil {
+		return err
+	}
+
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		images, err := listManifests(ctx, src, list)
+		if err != nil {
+			return err
+		}
+		for _, image := range images {
+			if err := copyManifest(ctx, src, dst, image, events); err != nil {
+				return err
+			}
+		}
+	}
+
+	var options []distribution.ManifestServiceOption
+	if tagged, ok := dstNamed.(reference.Tagged); ok {
+		options = append(options, distribution.WithTag(tagged.Tag()))
+	} else if _, ok := dstNamed.(reference.Digested); !ok {
+		options = append(options, distribution.WithTag("latest"))
+	}
+	return copyManifest(ctx, src, dst, manifest, events, options...)
+}
+
+// copyManifest copies the blobs manifest references that are missing at dst,
+// then pushes manifest to dst, by digest unless options set a tag.
+func copyManifest(ctx context.Context, src, dst distribution.Repository, manifest distribution.Manifest, events chan<- copyProgressEvent, options ...distribution.ManifestServiceOption) error {
+	if _, ok := manifest.(*manifestlist.DeserializedManifestList); !ok {
+		for _, descriptor := range manifest.References() {
+			if err := copyBlob(ctx, src, dst, descriptor, events); err != nil {
+				return fmt.Errorf("failed to copy blob %s: %w", descriptor.Digest, err)
+			}
+		}
+	}
+
+	manifests, err := dst.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := manifests.Put(ctx, manifest, options...); err != nil {
+		return fmt.Errorf("failed to push manifest: %w", err)
+	}
+	return nil
+}
+
+// listManifests fetches the manifests of the images of list from repository.
+func listManifests(ctx context.Context, repository distribution.Repository, list *manifestlist.DeserializedManifestList) ([]distribution.Manifest, error) {
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]distribution.Manifest, 0, len(list.Manifests))
+	for _, descriptor := range list.Manifests {
+		image, err := manifests.Get(ctx, descriptor.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get manifest %s: %w", descriptor.Digest, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// sourceManifest returns the repository and image manifest of srcImage,
+// trying the mirrors of registries.conf before the registry itself.
+func (d *DistributionRegistryManager) sourceManifest(ctx context.Context, srcImage string, credentials *RegistryCredentials) (distribution.Repository, distribution.Manifest, error) {
+	sources, err := d.pullSources(srcImage)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lg := log.FromContext(ctx)
+	srcHost := registryHost(srcImage)
+	var lastErr error
+	for _, source := range sources {
+		// the pull secret of the source registry is never sent to mirrors on
+		// other hosts, they get the credentials configured for their own host
+		// or are tried anonymously
+		sourceCredentials := credentials
+		if host := normalizeRegistryHost(reference.Domain(source.named)); host != srcHost {
+			if sourceCredentials, err = d.CredentialHelpers.Get(ctx, host, source.named.String()); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		repository, manifest, err := d.manifest(ctx, source.named, source.insecure, sourceCredentials)
+		if err == nil {
+			return repository, manifest, nil
+		}
+		if len(sources) > 1 {
+			lg.V(1).Info("failed to pull manifest", "source", source.named.String(), "error", err.Error())
+		}
+		lastErr = err
+	}
+	return nil, nil, lastErr
+}
+
+type pullSource struct {
+	named    reference.Named
+	insecure bool
+}
+
+// pullSources returns where srcImage can be pulled from in order of
+// preference, according to registries.conf.
+func (d *DistributionRegistryManager) pullSources(srcImage string) ([]pullSource, error) {
+	named, err := reference.ParseNormalizedNamed(srcImage)
+	if err != nil {
+		return nil, permanentErrorf("invalid source name %s: %v", srcImage, err)
+	}
+
+	d.registriesConfOnce.Do(func() {
+		d.registriesConf, d.registriesConfErr = loadRegistriesConf(d.RegistriesConfPath)
+	})
+	if d.registriesConfErr != nil {
+		return nil, fmt.Errorf("failed to read registries.conf: %v", d.registriesConfErr)
+	}
+	registry := d.registriesConf.findRegistry(named.Name())
+	if registry == nil {
+		return []pullSource{{named: named}}, nil
+	}
+	if registry.Blocked {
+		return nil, permanentErrorf("registry %s is blocked in registries.conf", registry.Prefix)
+	}
+	return registry.pullSources(named)
+}
+
+// manifest fetches the manifest of named. For manifest lists the manifest of
+// the linux image of the controller's architecture is returned, unless named
+// is pinned to the digest of the list. Then the list is returned, so the
+// backup keeps its digest.
+func (d *DistributionRegistryManager) manifest(ctx context.Context, named reference.Named, insecure bool, credentials *RegistryCredentials) (distribution.Repository, distribution.Manifest, error) {
+	repository, err := d.repository(ctx, named, insecure, credentials, "pull")
+	if err != nil {
+		return nil, nil, err
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var manifest distribution.Manifest
+	if digested, ok := named.(reference.Digested); ok {
+		manifest, err = manifests.Get(ctx, digested.Digest())
+	} else {
+		tag := "latest"
+		if tagged, ok := named.(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+		manifest, err = manifests.Get(ctx, "", distribution.WithTag(tag))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	list, ok := manifest.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		return repository, manifest, nil
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return repository, list, nil
+	}
+	for _, descriptor := range list.Manifests {
+		if descriptor.Platform.OS == "linux" && descriptor.Platform.Architecture == runtime.GOARCH {
+			manifest, err = manifests.Get(ctx, descriptor.Digest)
+			return repository, manifest, err
+		}
+	}
+	return nil, nil, permanentErrorf("no linux/%s image in manifest list of %s", runtime.GOARCH, named)
+}
+
+// repository returns a client for the repository of named, authorized for
+// actions.
+func (d *DistributionRegistryManager) repository(ctx context.Context, named reference.Named, insecure bool, credentials *RegistryCredentials, actions ...string) (distribution.Repository, error) {
+	host := normalizeRegistryHost(reference.Domain(named))
+	path := reference.Path(named)
+	endpoint, base, manager, err := d.endpoint(ctx, host, insecure)
+	if err != nil {
+		return nil, err
+	}
+	modifier := authorizer(base, manager, credentials, auth.RepositoryScope{Repository: path, Actions: actions})
+
+	name, err := reference.WithName(path)
+	if err != nil {
+		return nil, permanentErrorf("invalid repository %s: %v", path, err)
+	}
+	return client.NewRepository(name, endpoint, transport.NewTransport(d.throttled(host, base), modifier))
+}
+
+// CheckCredentials logs into the registry of credentials.
+func (d *DistributionRegistryManager) CheckCredentials(ctx context.Context, credentials *RegistryCredentials) error {
+	host := normalizeRegistryHost(strings.Split(credentials.URL, "/")[0])
+	endpoint, base, manager, err := d.endpoint(ctx, host, false)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{Transport: transport.NewTransport(base, authorizer(base, manager, credentials)), Timeout: time.Minute}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("failed to log into registry %s: %w", host, errcode.ErrorCodeUnauthorized.WithDetail(resp.Status))
+	case !client.SuccessStatus(resp.StatusCode):
+		return fmt.Errorf("failed to log into registry %s: %w", host, client.HandleErrorResponse(resp))
+	}
+	return nil
+}
+
+// endpoint pings the registry at host and returns its endpoint, the transport
+// to it and its authentication challenges. Insecure registries are pinged
+// with plain HTTP if they don't serve HTTPS.
+func (d *DistributionRegistryManager) endpoint(ctx context.Context, host string, insecure bool) (string, http.RoundTripper, challenge.Manager, error) {
+	endpointHost := host
+	if host == "docker.io" {
+		endpointHost = dockerHubEndpoint
+	}
+
+	if hostTLS := d.RegistryConfig.hostConfig(host).TLS; hostTLS != nil && hostTLS.Insecure {
+		insecure = true
+	}
+	base, err := d.transport(host, insecure)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	endpoint := "https://" + endpointHost
+	resp, err := ping(ctx, base, endpoint)
+	if err != nil && insecure {
+		endpoint = "http://" + endpointHost
+		resp, err = ping(ctx, base, endpoint)
+	}
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to ping registry %s: %w", host, err)
+	}
+
+	manager := challenge.NewSimpleManager()
+	if err := manager.AddResponse(resp); err != nil {
+		return "", nil, nil, err
+	}
+	return endpoint, base, manager, nil
+}
+
+// authorizer returns the request modifier authenticating requests to a
+// registry with credentials, using tokens for scopes if the registry asks for
+// them.
+func authorizer(base http.RoundTripper, manager challenge.Manager, credentials *RegistryCredentials, scopes ...auth.Scope) transport.RequestModifier {
+	if credentials != nil && credentials.RegistryToken != "" {
+		// registry tokens are used as is, without asking the token service
+		return transport.NewHeaderRequestModifier(http.Header{"Authorization": []string{"Bearer " + credentials.RegistryToken}})
+	}
+	store := basicCredentialStore{credentials: credentials}
+	tokenHandler := auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+		Transport:   base,
+		Credentials: store,
+		Scopes:      scopes,
+	})
+	return auth.NewAuthorizer(manager, tokenHandler, auth.NewBasicHandler(store))
+}
+
+// transport returns the transport to the registry at host. It is shared by
+// all copies from and to the registry, so their connections are reused, and
+// closes connections idle for registryIdleConnTimeout.
+func (d *DistributionRegistryManager) transport(host string, insecure bool) (*http.Transport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := registryTransportKey{host: host, insecure: insecure}
+	if base, ok := d.transports[key]; ok {
+		return base, nil
+	}
+	tlsConfig, _, err := d.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.InsecureSkipVerify = insecure
+	base := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: registryIdleConnTimeout,
+	}
+	if d.transports == nil {
+		d.transports = make(map[registryTransportKey]*http.Transport)
+	}
+	d.transports[key] = base
+	return base, nil
+}
+
+type registryTransportKey struct {
+	host     string
+	insecure bool
+}
+
+// tlsConfig returns the TLS settings of host from the registry config and
+// whether the registry is insecure. CertDir uses the layout of docker's
+// certs.d like containers/image.
+func (d *DistributionRegistryManager) tlsConfig(host string) (*tls.Config, bool, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	hostTLS := d.RegistryConfig.hostConfig(host).TLS
+	if hostTLS == nil {
+		return tlsConfig, false, nil
+	}
+	if hostTLS.CertDir == "" {
+		return tlsConfig, hostTLS.Insecure, nil
+	}
+
+	files, err := ioutil.ReadDir(hostTLS.CertDir)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range files {
+		path := filepath.Join(hostTLS.CertDir, f.Name())
+		switch {
+		case strings.HasSuffix(f.Name(), ".crt"):
+			if tlsConfig.RootCAs == nil {
+				if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+					tlsConfig.RootCAs = x509.NewCertPool()
+				}
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, false, err
+			}
+			tlsConfig.RootCAs.AppendCertsFromPEM(data)
+		case strings.HasSuffix(f.Name(), ".cert"):
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path, keyPath)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to load client certificate %s: %v", path, err)
+			}
+			tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		}
+	}
+	return tlsConfig, hostTLS.Insecure, nil
+}
+
+func ping(ctx context.Context, base http.RoundTripper, endpoint string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v2/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: base, Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// copyBlob copies a single blob unless the destination already has it.
+func copyBlob(ctx context.Context, src, dst distribution.Repository, descriptor distribution.Descriptor, events chan<- copyProgressEvent) error {
+	blobs := dst.Blobs(ctx)
+
+	_, err := blobs.Stat(ctx, descriptor.Digest)
+	if err == nil {
+		events <- copyProgressEvent{kind: copyProgressBlobSkipped, size: descriptor.Size}
+		return nil
+	}
+	if !errors.Is(err, distribution.ErrBlobUnknown) {
+		return err
+	}
+
+	reader, err := src.Blobs(ctx).Open(ctx, descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := blobs.Create(ctx)
+	if err != nil {
+		return err
+	}
+	events <- copyProgressEvent{kind: copyProgressBlobStarted, size: descriptor.Size}
+	if _, err := io.Copy(writer, &progressReader{reader: reader, events: events}); err != nil {
+		_ = writer.Cancel(ctx)
+		return err
+	}
+	_, err = writer.Commit(ctx, descriptor)
+	return err
+}
+
+// progressReader emits progress events for the blob read through it, at
+// most every copyProgressEventInterval and once it's done.
+type progressReader struct {
+	reader    io.Reader
+	events    chan<- copyProgressEvent
+	pending   uint64
+	lastEvent time.Time
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pending += uint64(n)
+	if err == io.EOF || time.Since(r.lastEvent) >= copyProgressEventInterval {
+		r.events <- copyProgressEvent{kind: copyProgressBlobRead, bytesRead: r.pending}
+		r.pending = 0
+		r.lastEvent = time.Now()
+	}
+	return n, err
+}
+
+// basicCredentialStore hands the same username and password, or identity
+// token, to the token and basic auth handlers of every registry.
+type basicCredentialStore struct {
+	credentials *RegistryCredentials
+}
+
+func (s basicCredentialStore) Basic(*url.URL) (string, string) {
+	if s.credentials == nil {
+		return "", ""
+	}
+	return s.credentials.Username, s.credentials.Password
+}
+
+func (s basicCredentialStore) RefreshToken(*url.URL, string) string {
+	if s.credentials == nil {
+		return ""
+	}
+	return s.credentials.IdentityToken
+}
+
+func (s basicCredentialStore) SetRefreshToken(*url.URL, string, string) {
+}
+
+// throttleTransport holds back copies from and to host for as long as the
+// registry asks when it answers 429 Too Many Requests.
+type throttleTransport struct {
+	base    http.RoundTripper
+	host    string
+	limiter *RegistryRateLimiter
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		t.limiter.Pause(t.host, retryAfter(resp.Header, DEFAULT_THROTTLE_PAUSE))
+	}
+	return resp, err
+}
+
+// throttled returns base, pausing host when the registry throttles requests.
+func (d *DistributionRegistryManager) throttled(host string, base http.RoundTripper) http.RoundTripper {
+	if d.RateLimiter == nil {
+		return base
+	}
+	return &throttleTransport{base: base, host: host, limiter: d.RateLimiter}
+}
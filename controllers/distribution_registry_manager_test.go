@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressReader(t *testing.T) {
+
+	events := make(chan copyProgressEvent, 10)
+	reader := &progressReader{reader: bytes.NewReader(make([]byte, 100)), events: events}
+	n, err := io.Copy(ioutil.Discard, reader)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), n)
+	close(events)
+
+	var copied uint64
+	for e := range events {
+		assert.Equal(t, copyProgressBlobRead, e.kind)
+		copied += e.bytesRead
+	}
+	assert.Equal(t, uint64(100), copied)
+}
+
+func TestDistributionTLSConfig(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	certDir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(certDir, "ca.crt"), ca, 0600))
+
+	d := &DistributionRegistryManager{RegistryConfig: &RegistryConfig{Registries: map[string]RegistryHostConfig{
+		"registry.internal": {TLS: &TLSConfig{CertDir: certDir}},
+		"backup.lab":        {TLS: &TLSConfig{Insecure: true}},
+	}}}
+
+	tlsConfig, insecure, err := d.tlsConfig("registry.internal")
+	assert.NoError(t, err)
+	assert.False(t, insecure)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	_, err = client.Get(server.URL)
+	assert.NoError(t, err)
+
+	_, insecure, err = d.tlsConfig("backup.lab")
+	assert.NoError(t, err)
+	assert.True(t, insecure)
+}
+
+func TestDistributionTransportReuse(t *testing.T) {
+
+	registry := newTestRegistry(t, "", "")
+	d := &DistributionRegistryManager{RegistryConfig: testRegistryConfig(t, registry)}
+
+	ctx := context.Background()
+	_, first, _, err := d.endpoint(ctx, registry.Host, false)
+	assert.NoError(t, err)
+	_, second, _, err := d.endpoint(ctx, registry.Host, false)
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, registryIdleConnTimeout, first.(*http.Transport).IdleConnTimeout)
+
+	_, insecure, _, err := d.endpoint(ctx, registry.Host, true)
+	assert.NoError(t, err)
+	assert.NotSame(t, first, insecure)
+}
+
+func TestDistributionImageSizeRateLimit(t *testing.T) {
+
+	registry := newTestRegistry(t, "", "")
+	registry.PushImage(t, "app", "v1")
+	d := &DistributionRegistryManager{RegistryConfig: testRegistryConfig(t, registry)}
+	d.RateLimiter = NewRegistryRateLimiter(d.RegistryConfig)
+	d.RateLimiter.Pause(registry.Host, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err := d.ImageSize(ctx, registry.Host+"/app:v1", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDistributionCopiesPinnedManifestList(t *testing.T) {
+
+	src := newTestRegistry(t, "", "")
+	dst := newTestRegistry(t, "", "")
+	list := src.PushImageList(t, "app", "v1")
+	amd64, _ := src.Manifest("app", "v1-amd64")
+	arm64, _ := src.Manifest("app", "v1-arm64")
+	d := registryManagerFactories[REGISTRY_BACKEND_DISTRIBUTION](testRegistryConfig(t, src, dst), t)
+	ctx := context.Background()
+
+	// the digest of the list stays valid in the backup registry
+	dgst := sha256Digest(list)
+	assert.NoError(t, d.CopyImage(ctx, src.Host+"/app@"+dgst, dst.Host+"/backup/app@"+dgst, nil, nil))
+	copied, ok := dst.Manifest("backup/app", dgst)
+	assert.True(t, ok)
+	assert.Equal(t, list, copied)
+	for _, image := range [][]byte{amd64, arm64} {
+		_, ok := dst.Manifest("backup/app", sha256Digest(image))
+		assert.True(t, ok)
+	}
+
+	size, err := d.ImageSize(ctx, src.Host+"/app@"+dgst, nil)
+	assert.NoError(t, err)
+	platformSize, err := d.ImageSize(ctx, src.Host+"/app:v1-amd64", nil)
+	assert.NoError(t, err)
+	assert.Greater(t, size, platformSize)
+
+	// tags get the image of the controller's platform
+	assert.NoError(t, d.CopyImage(ctx, src.Host+"/app:v1", dst.Host+"/backup/app:v1", nil, nil))
+	copied, ok = dst.Manifest("backup/app", "v1")
+	assert.True(t, ok)
+	if runtime.GOARCH == "amd64" {
+		assert.Equal(t, amd64, copied)
+	}
+}
+
+func TestDistributionRetryAfter(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v2/" {
+			return
+		}
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	config := &RegistryConfig{Registries: map[string]RegistryHostConfig{host: {TLS: &TLSConfig{Insecure: true}}}}
+	d := &DistributionRegistryManager{RegistryConfig: config, RateLimiter: NewRegistryRateLimiter(config)}
+
+	_, err := d.ImageSize(context.Background(), host+"/app:v1", nil)
+	assert.Error(t, err)
+
+	// the registry is paused for as long as it asked
+	d.RateLimiter.mu.Lock()
+	pausedUntil := d.RateLimiter.pausedUntil[host]
+	d.RateLimiter.mu.Unlock()
+	assert.WithinDuration(t, time.Now().Add(time.Second*120), pausedUntil, time.Second*10)
+}
+
+func TestDistributionMirrorCredentials(t *testing.T) {
+
+	// both registries ask for basic auth and record the credentials they get
+	var mu sync.Mutex
+	received := map[string][]string{}
+	newRegistry := func(name string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if authorization := req.Header.Get("Authorization"); authorization != "" {
+				mu.Lock()
+				received[name] = append(received[name], authorization)
+				mu.Unlock()
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	source, mirror := newRegistry("source"), newRegistry("mirror")
+
+	path := filepath.Join(t.TempDir(), "registries.conf")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`
+[[registry]]
+location = "%s"
+insecure = true
+
+[[registry.mirror]]
+location = "%s"
+insecure = true
+`, source, mirror)), 0600))
+	d := &DistributionRegistryManager{RegistryConfig: &RegistryConfig{}, RegistriesConfPath: path}
+
+	_, err := d.ImageSize(context.Background(), source+"/app:v1", &RegistryCredentials{Username: "user", Password: "secret"})
+	assert.Error(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotEmpty(t, received["source"])
+	assert.Empty(t, received["mirror"], "the pull secret of the source registry was sent to its mirror")
+}
@@ -3,7 +3,9 @@ package controllers
 import (
 	"errors"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func GetIgnoreNamespacesEnv() []string {
@@ -40,6 +42,67 @@ func GetBackUpRegistryURLEnv() (string, error) {
 	return env, nil
 }
 
+// GetBackUpRegistrySecretEnv reads the Secret holding the backup registry
+// credentials as "namespace/name" or "name" in the namespace of the
+// controller. An empty name means the credentials come from the environment.
+func GetBackUpRegistrySecretEnv() (string, string, error) {
+	var backUpRegistrySecretEnvVar = "BACKUP_REGISTRY_SECRET"
+
+	return getSecretEnv(backUpRegistrySecretEnvVar)
+}
+
+// GetBackUpRegistryPullSecretEnv reads the Secret holding the pull credentials
+// of the backup registry like GetBackUpRegistrySecretEnv. An empty name means
+// there are no global pull credentials.
+func GetBackUpRegistryPullSecretEnv() (string, string, error) {
+	var backUpRegistryPullSecretEnvVar = "BACKUP_REGISTRY_PULL_SECRET"
+
+	return getSecretEnv(backUpRegistryPullSecretEnvVar)
+}
+
+// GetPullSecretNameEnv reads the name of the pull secrets of the backup
+// registry created in the namespaces of the workloads.
+func GetPullSecretNameEnv() string {
+	var pullSecretNameEnvVar = "PULL_SECRET_NAME"
+
+	env, found := os.LookupEnv(pullSecretNameEnvVar)
+	if !found || env == "" {
+		return DESTINATION_SECRET_NAME
+	}
+	return env
+}
+
+// GetPullSecretServiceAccountsEnv reads whether the pull secrets of the backup
+// registry are attached to the ServiceAccounts instead of the pod templates.
+func GetPullSecretServiceAccountsEnv() (bool, error) {
+	var pullSecretServiceAccountsEnvVar = "PULL_SECRET_SERVICE_ACCOUNTS"
+
+	env, found := os.LookupEnv(pullSecretServiceAccountsEnvVar)
+	if !found {
+		return false, nil
+	}
+	serviceAccounts, err := strconv.ParseBool(env)
+	if err != nil {
+		return false, errors.New(pullSecretServiceAccountsEnvVar + " must be a boolean")
+	}
+	return serviceAccounts, nil
+}
+
+func getSecretEnv(envVar string) (string, string, error) {
+	env, found := os.LookupEnv(envVar)
+	if !found || env == "" {
+		return "", "", nil
+	}
+	if parts := strings.SplitN(env, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+	namespace := GetPodNameSpaceEnv()
+	if namespace == "" {
+		return "", "", errors.New(envVar + " must be namespace/name if MY_POD_NAMESPACE is not set")
+	}
+	return namespace, env, nil
+}
+
 func GetBackUpRegistryUserNameEnv() (string, error) {
 	var backUpRegistryUserNameEnvVar = "BACKUP_REGISTRY_USERNAME"
 
@@ -60,6 +123,164 @@ func GetBackUpRegistryPasswordEnv() (string, error) {
 	return env, nil
 }
 
+func GetCopyWorkersEnv() (int, error) {
+	var copyWorkersEnvVar = "COPY_WORKERS"
+
+	env, found := os.LookupEnv(copyWorkersEnvVar)
+	if !found {
+		return DEFAULT_COPY_WORKERS, nil
+	}
+	workers, err := strconv.Atoi(env)
+	if err != nil || workers < 1 {
+		return 0, errors.New(copyWorkersEnvVar + " must be a positive integer")
+	}
+	return workers, nil
+}
+
+func GetCopyProgressIntervalEnv() (time.Duration, error) {
+	var copyProgressIntervalEnvVar = "COPY_PROGRESS_INTERVAL"
+
+	env, found := os.LookupEnv(copyProgressIntervalEnvVar)
+	if !found {
+		return DEFAULT_COPY_PROGRESS_INTERVAL, nil
+	}
+	interval, err := time.ParseDuration(env)
+	if err != nil || interval <= 0 {
+		return 0, errors.New(copyProgressIntervalEnvVar + " must be a positive duration")
+	}
+	return interval, nil
+}
+
+func GetReportStatusEnv() bool {
+	var reportStatusEnvVar = "REPORT_STATUS"
+
+	env, found := os.LookupEnv(reportStatusEnvVar)
+	if !found {
+		return false
+	}
+	reportStatus, _ := strconv.ParseBool(env)
+	return reportStatus
+}
+
+func GetBlobInfoCacheDirEnv() string {
+	var blobInfoCacheDirEnvVar = "BLOB_INFO_CACHE_DIR"
+
+	env, found := os.LookupEnv(blobInfoCacheDirEnvVar)
+	if !found {
+		return ""
+	}
+	return env
+}
+
+func GetCopyTempDirEnv() string {
+	var copyTempDirEnvVar = "COPY_TEMP_DIR"
+
+	env, found := os.LookupEnv(copyTempDirEnvVar)
+	if !found {
+		return ""
+	}
+	return env
+}
+
+// GetBackupArchiveEnv reads the directory images are additionally archived to
+// and the archive format. An empty directory disables the archive.
+func GetBackupArchiveEnv() (string, string, error) {
+	var archiveDirEnvVar = "BACKUP_ARCHIVE_DIR"
+	var archiveFormatEnvVar = "BACKUP_ARCHIVE_FORMAT"
+
+	dir, found := os.LookupEnv(archiveDirEnvVar)
+	if !found {
+		return "", "", nil
+	}
+
+	format, found := os.LookupEnv(archiveFormatEnvVar)
+	if !found {
+		return dir, ARCHIVE_FORMAT_OCI, nil
+	}
+	if format != ARCHIVE_FORMAT_OCI && format != ARCHIVE_FORMAT_DOCKER_ARCHIVE {
+		return "", "", errors.New(archiveFormatEnvVar + " must be " + ARCHIVE_FORMAT_OCI + " or " + ARCHIVE_FORMAT_DOCKER_ARCHIVE)
+	}
+	return dir, format, nil
+}
+
+func GetBackupPolicyEnv() (BackupPolicy, error) {
+	var backupPolicyEnvVar = "BACKUP_POLICY"
+
+	env, found := os.LookupEnv(backupPolicyEnvVar)
+	if !found {
+		return BACKUP_POLICY_ALL, nil
+	}
+	policy := BackupPolicy(env)
+	if policy != BACKUP_POLICY_ALL && policy != BACKUP_POLICY_ANY {
+		return "", errors.New(backupPolicyEnvVar + " must be " + string(BACKUP_POLICY_ALL) + " or " + string(BACKUP_POLICY_ANY))
+	}
+	return policy, nil
+}
+
+func GetCopyTimeoutEnv() (time.Duration, error) {
+	var copyTimeoutEnvVar = "COPY_TIMEOUT"
+
+	env, found := os.LookupEnv(copyTimeoutEnvVar)
+	if !found {
+		return DEFAULT_COPY_TIMEOUT, nil
+	}
+	timeout, err := time.ParseDuration(env)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New(copyTimeoutEnvVar + " must be a positive duration")
+	}
+	return timeout, nil
+}
+
+func GetCopyShutdownTimeoutEnv() (time.Duration, error) {
+	var copyShutdownTimeoutEnvVar = "COPY_SHUTDOWN_TIMEOUT"
+
+	env, found := os.LookupEnv(copyShutdownTimeoutEnvVar)
+	if !found {
+		return DEFAULT_COPY_SHUTDOWN_TIMEOUT, nil
+	}
+	timeout, err := time.ParseDuration(env)
+	if err != nil || timeout < 0 {
+		return 0, errors.New(copyShutdownTimeoutEnvVar + " must be a non-negative duration")
+	}
+	return timeout, nil
+}
+
+// GetMaxImageSizeEnv reads the maximum size of images to back up as resource
+// quantity, e.g. "5Gi". Zero means unlimited.
+func GetMaxImageSizeEnv() (int64, error) {
+	var maxImageSizeEnvVar = "MAX_IMAGE_SIZE"
+
+	env, found := os.LookupEnv(maxImageSizeEnvVar)
+	if !found || env == "" {
+		return 0, nil
+	}
+	maxSize, err := ParseImageSize(env)
+	if err != nil {
+		return 0, errors.New(maxImageSizeEnvVar + ": " + err.Error())
+	}
+	return maxSize, nil
+}
+
+func GetRegistryConfigPathEnv() string {
+	var registryConfigPathEnvVar = "REGISTRY_CONFIG_PATH"
+
+	env, found := os.LookupEnv(registryConfigPathEnvVar)
+	if !found {
+		return ""
+	}
+	return env
+}
+
+func GetRegistriesConfPathEnv() string {
+	var registriesConfPathEnvVar = "REGISTRIES_CONF_PATH"
+
+	env, found := os.LookupEnv(registriesConfPathEnvVar)
+	if !found {
+		return ""
+	}
+	return env
+}
+
 func GetPodNameSpaceEnv() string {
 	var nameSpaceEnvVar = "MY_POD_NAMESPACE"
 
@@ -69,3 +290,73 @@ func GetPodNameSpaceEnv() string {
 	}
 	return env
 }
+
+// GetRetryPolicyEnv reads the image copy retry policy. Unset variables keep
+// their defaults, durations use time.ParseDuration syntax (e.g. "30s").
+func GetRetryPolicyEnv() (RetryPolicy, error) {
+	var maxRetriesEnvVar = "COPY_MAX_RETRIES"
+	var initialBackoffEnvVar = "COPY_INITIAL_BACKOFF"
+	var maxBackoffEnvVar = "COPY_MAX_BACKOFF"
+
+	policy := DefaultRetryPolicy()
+
+	if env, found := os.LookupEnv(maxRetriesEnvVar); found {
+		maxRetries, err := strconv.Atoi(env)
+		if err != nil || maxRetries < 0 {
+			return policy, errors.New(maxRetriesEnvVar + " must be a non-negative integer")
+		}
+		policy.MaxRetries = maxRetries
+	}
+
+	if env, found := os.LookupEnv(initialBackoffEnvVar); found {
+		initialBackoff, err := time.ParseDuration(env)
+		if err != nil || initialBackoff <= 0 {
+			return policy, errors.New(initialBackoffEnvVar + " must be a positive duration")
+		}
+		policy.InitialBackoff = initialBackoff
+	}
+
+	if env, found := os.LookupEnv(maxBackoffEnvVar); found {
+		maxBackoff, err := time.ParseDuration(env)
+		if err != nil || maxBackoff <= 0 {
+			return policy, errors.New(maxBackoffEnvVar + " must be a positive duration")
+		}
+		policy.MaxBackoff = maxBackoff
+	}
+
+	if policy.MaxBackoff < policy.InitialBackoff {
+		return policy, errors.New(maxBackoffEnvVar + " must not be smaller than " + initialBackoffEnvVar)
+	}
+	return policy, nil
+}
+
+// GetImageScannerEnv reads the scanning endpoint backup images must pass
+// before workloads are rewritten. Without SCAN_URL no scanner is used.
+func GetImageScannerEnv() (*ImageScanner, error) {
+	var scanURLEnvVar = "SCAN_URL"
+	var scanFailOpenEnvVar = "SCAN_FAIL_OPEN"
+	var scanTimeoutEnvVar = "SCAN_TIMEOUT"
+
+	url, found := os.LookupEnv(scanURLEnvVar)
+	if !found || url == "" {
+		return nil, nil
+	}
+	scanner := &ImageScanner{URL: url, Timeout: DEFAULT_SCAN_TIMEOUT}
+
+	if env, found := os.LookupEnv(scanFailOpenEnvVar); found {
+		failOpen, err := strconv.ParseBool(env)
+		if err != nil {
+			return nil, errors.New(scanFailOpenEnvVar + " must be a boolean")
+		}
+		scanner.FailOpen = failOpen
+	}
+
+	if env, found := os.LookupEnv(scanTimeoutEnvVar); found {
+		timeout, err := time.ParseDuration(env)
+		if err != nil || timeout <= 0 {
+			return nil, errors.New(scanTimeoutEnvVar + " must be a positive duration")
+		}
+		scanner.Timeout = timeout
+	}
+	return scanner, nil
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// MAX_IMAGE_SIZE_ANNOTATION limits the size of the images of a single
+	// workload, e.g. "2Gi". It can only lower the global maximum.
+	MAX_IMAGE_SIZE_ANNOTATION = "imagebackup.junaidk.io/max-image-size"
+)
+
+// ImageTooLargeError is the reason an image was not backed up because it is
+// larger than the allowed maximum.
+type ImageTooLargeError struct {
+	Image   string
+	Size    int64
+	MaxSize int64
+}
+
+func (e *ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image %s is %s, larger than the maximum image size of %s", e.Image,
+		resource.NewQuantity(e.Size, resource.BinarySI), resource.NewQuantity(e.MaxSize, resource.BinarySI))
+}
+
+// ParseImageSize parses a size given as resource quantity, e.g. "500Mi".
+func ParseImageSize(size string) (int64, error) {
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, err
+	}
+	if quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("image size %s must be positive", size)
+	}
+	return quantity.Value(), nil
+}
+
+// maxImageSize returns the maximum image size for the workload obj, which is
+// the smaller of the global maximum and the max-image-size annotation. Zero
+// means unlimited.
+func maxImageSize(obj client.Object, globalMaxSize int64) (int64, error) {
+	annotation, ok := obj.GetAnnotations()[MAX_IMAGE_SIZE_ANNOTATION]
+	if !ok {
+		return globalMaxSize, nil
+	}
+
+	maxSize, err := ParseImageSize(annotation)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation: %v", MAX_IMAGE_SIZE_ANNOTATION, err)
+	}
+	if globalMaxSize > 0 && globalMaxSize < maxSize {
+		return globalMaxSize, nil
+	}
+	return maxSize, nil
+}
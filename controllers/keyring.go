@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"net"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// dockerHubV1Key is the key docker login writes for Docker Hub.
+const dockerHubV1Key = "index.docker.io/v1/"
+
+// registryKeyring holds the entries of pull secrets and finds the credentials
+// of an image with the matching rules of the kubelet:
+//
+//   - keys may have a scheme and a path, "quay.io/team" matches the images
+//     whose repository starts with "team"
+//   - "*" matches a single domain component, "*.gcr.io" matches "eu.gcr.io"
+//     but not "gcr.io"
+//   - ports have to be equal
+//   - the most specific key wins, for equal keys the first pull secret
+//   - Docker Hub images match index.docker.io, docker.io and
+//     https://index.docker.io/v1/
+type registryKeyring struct {
+	entries []keyringEntry
+}
+
+type keyringEntry struct {
+	// key is the schemeless registry URL the entries are sorted by.
+	key         string
+	host        string
+	port        string
+	path        string
+	credentials *RegistryCredentials
+}
+
+func newKeyringEntry(url string) keyringEntry {
+	key := strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://")
+	if key == dockerHubV1Key || key == strings.TrimSuffix(dockerHubV1Key, "/") {
+		key = DEFAULT_DOCKER_REGISTRY
+	}
+	key = strings.TrimSuffix(key, "/")
+
+	entry := keyringEntry{key: key}
+	parts := strings.SplitN(key, "/", 2)
+	entry.host = parts[0]
+	if len(parts) == 2 {
+		entry.path = parts[1]
+	}
+	if host, port, err := net.SplitHostPort(entry.host); err == nil {
+		entry.host, entry.port = host, port
+	}
+	return entry
+}
+
+// matchesHost reports whether the host of the entry matches host, which may
+// include a port.
+func (e keyringEntry) matchesHost(host string) bool {
+	port := ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	if port != e.port {
+		return false
+	}
+	if normalizeRegistryHost(host) == "docker.io" && normalizeRegistryHost(e.host) == "docker.io" {
+		return true
+	}
+
+	globParts := strings.Split(e.host, ".")
+	hostParts := strings.Split(host, ".")
+	if len(globParts) != len(hostParts) {
+		return false
+	}
+	for i := range globParts {
+		if matched, err := path.Match(globParts[i], hostParts[i]); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (k *registryKeyring) add(credentials ...*RegistryCredentials) {
+	for _, c := range credentials {
+		entry := newKeyringEntry(c.URL)
+		entry.credentials = c
+		k.entries = append(k.entries, entry)
+	}
+	// like the kubelet, reverse order puts longer keys in front of their prefixes
+	sort.SliceStable(k.entries, func(i, j int) bool {
+		return k.entries[i].key > k.entries[j].key
+	})
+}
+
+// lookup returns the credentials of image, or nil if no entry matches.
+func (k *registryKeyring) lookup(image string) *RegistryCredentials {
+	if k == nil {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+	host, repository := reference.Domain(named), reference.Path(named)
+	for _, entry := range k.entries {
+		if entry.matchesHost(host) && strings.HasPrefix(repository, entry.path) {
+			return entry.credentials
+		}
+	}
+	return nil
+}
+
+// registries returns the keys of the entries, e.g. for logging.
+func (k *registryKeyring) registries() []string {
+	if k == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(k.entries))
+	for _, entry := range k.entries {
+		keys = append(keys, entry.key)
+	}
+	return keys
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryKeyringLookup(t *testing.T) {
+
+	hub := &RegistryCredentials{URL: "https://index.docker.io/v1/", Username: "hub"}
+	ghcr := &RegistryCredentials{URL: "ghcr.io", Username: "ghcr"}
+	team := &RegistryCredentials{URL: "https://quay.io/team", Username: "team"}
+	quay := &RegistryCredentials{URL: "quay.io", Username: "quay"}
+	gcr := &RegistryCredentials{URL: "*.gcr.io", Username: "gcr"}
+	local := &RegistryCredentials{URL: "registry.local:5000", Username: "local"}
+
+	keyring := &registryKeyring{}
+	keyring.add(hub, ghcr)
+	keyring.add(quay, team, gcr, local)
+
+	tests := []struct {
+		image    string
+		expected *RegistryCredentials
+	}{
+		{"nginx:1.21", hub},
+		{"library/nginx", hub},
+		{"docker.io/bitnami/redis", hub},
+		{"index.docker.io/bitnami/redis", hub},
+		{"ghcr.io/org/app:v1", ghcr},
+		{"quay.io/team/app", team},
+		{"quay.io/other/app", quay},
+		{"eu.gcr.io/project/app", gcr},
+		{"gcr.io/project/app", nil},
+		{"registry.local:5000/app", local},
+		{"registry.local/app", nil},
+		{"registry.example.com/app", nil},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, keyring.lookup(test.image), test.image)
+	}
+}
+
+func TestRegistryKeyringFirstSecretWins(t *testing.T) {
+
+	first := &RegistryCredentials{URL: "quay.io", Username: "first"}
+	second := &RegistryCredentials{URL: "https://quay.io/", Username: "second"}
+
+	keyring := &registryKeyring{}
+	keyring.add(first)
+	keyring.add(second)
+	assert.Equal(t, first, keyring.lookup("quay.io/app"))
+
+	var empty *registryKeyring
+	assert.Nil(t, empty.lookup("quay.io/app"))
+}
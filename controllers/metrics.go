@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	rateLimitWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_backup_rate_limit_wait_seconds",
+		Help:    "Time image copies waited for the rate limit of a registry.",
+		Buckets: []float64{0.1, 1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"registry"})
+
+	registryThrottledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_backup_registry_throttled_total",
+		Help: "Number of image copies rejected by a registry with 429 Too Many Requests.",
+	}, []string{"registry"})
+
+	copiedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_backup_copied_bytes_total",
+		Help: "Number of image bytes copied to the backup registry, by source registry.",
+	}, []string{"registry"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(rateLimitWaitSeconds, registryThrottledTotal, copiedBytesTotal)
+}
@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	DEFAULT_COPY_PROGRESS_INTERVAL = time.Second * 30
+
+	// copyProgressEventInterval is how often the registry managers report the
+	// progress of a single blob. It is independent of the log interval so the
+	// byte counters stay accurate.
+	copyProgressEventInterval = time.Second
+)
+
+type copyProgressEventKind int
+
+const (
+	// copyProgressBlobStarted is sent before a blob is copied.
+	copyProgressBlobStarted copyProgressEventKind = iota
+	// copyProgressBlobRead is sent while a blob is copied and once it's done.
+	copyProgressBlobRead
+	// copyProgressBlobSkipped is sent for blobs the destination already has.
+	copyProgressBlobSkipped
+)
+
+// copyProgressEvent is a progress event of a single blob. The registry
+// managers translate the events of their libraries into these.
+type copyProgressEvent struct {
+	kind copyProgressEventKind
+	// size is the size of the blob, if known.
+	size int64
+	// bytesRead is the number of bytes copied since the last event.
+	bytesRead uint64
+}
+
+// CopyProgress counts the bytes transferred by a running image copy. It is
+// safe for concurrent use.
+type CopyProgress struct {
+	bytesCopied  int64
+	bytesTotal   int64
+	blobsSkipped int64
+}
+
+func (p *CopyProgress) BytesCopied() int64 {
+	return atomic.LoadInt64(&p.bytesCopied)
+}
+
+// BytesTotal is the size of all blobs that need to be copied, as far as they
+// are known yet.
+func (p *CopyProgress) BytesTotal() int64 {
+	return atomic.LoadInt64(&p.bytesTotal)
+}
+
+func (p *CopyProgress) BlobsSkipped() int64 {
+	return atomic.LoadInt64(&p.blobsSkipped)
+}
+
+// reset clears the counters before a copy is retried.
+func (p *CopyProgress) reset() {
+	atomic.StoreInt64(&p.bytesCopied, 0)
+	atomic.StoreInt64(&p.bytesTotal, 0)
+	atomic.StoreInt64(&p.blobsSkipped, 0)
+}
+
+type copyProgressKey struct{}
+
+// withCopyProgress returns a context that lets the RegistryManager report the
+// progress of the copy it runs with that context to progress.
+func withCopyProgress(ctx context.Context, progress *CopyProgress) context.Context {
+	return context.WithValue(ctx, copyProgressKey{}, progress)
+}
+
+func copyProgressFromContext(ctx context.Context) *CopyProgress {
+	if progress, ok := ctx.Value(copyProgressKey{}).(*CopyProgress); ok {
+		return progress
+	}
+	return &CopyProgress{}
+}
+
+// reportCopyProgress consumes the progress events of a copy until the channel
+// is closed, updating progress and the copied bytes metric, and logs a summary
+// every interval.
+func reportCopyProgress(lg logr.Logger, events <-chan copyProgressEvent, progress *CopyProgress, srcHost string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				lg.Info("copy finished", "bytesCopied", progress.BytesCopied(), "bytesTotal", progress.BytesTotal(), "blobsSkipped", progress.BlobsSkipped())
+				return
+			}
+			switch e.kind {
+			case copyProgressBlobStarted:
+				if e.size > 0 {
+					atomic.AddInt64(&progress.bytesTotal, e.size)
+				}
+			case copyProgressBlobRead:
+				atomic.AddInt64(&progress.bytesCopied, int64(e.bytesRead))
+				copiedBytesTotal.WithLabelValues(srcHost).Add(float64(e.bytesRead))
+			case copyProgressBlobSkipped:
+				atomic.AddInt64(&progress.blobsSkipped, 1)
+			}
+		case <-ticker.C:
+			lg.Info("copy progress", "bytesCopied", progress.BytesCopied(), "bytesTotal", progress.BytesTotal(), "blobsSkipped", progress.BlobsSkipped())
+		}
+	}
+}
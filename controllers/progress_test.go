@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestReportCopyProgress(t *testing.T) {
+
+	events := make(chan copyProgressEvent)
+	progress := &CopyProgress{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reportCopyProgress(ctrl.Log, events, progress, "docker.io", time.Minute)
+	}()
+
+	events <- copyProgressEvent{kind: copyProgressBlobStarted, size: 300}
+	events <- copyProgressEvent{kind: copyProgressBlobRead, bytesRead: 100}
+	events <- copyProgressEvent{kind: copyProgressBlobRead, bytesRead: 200}
+	events <- copyProgressEvent{kind: copyProgressBlobSkipped, size: 50}
+	close(events)
+	<-done
+
+	assert.Equal(t, int64(300), progress.BytesCopied())
+	assert.Equal(t, int64(300), progress.BytesTotal())
+	assert.Equal(t, int64(1), progress.BlobsSkipped())
+}
+
+func TestSetBackupStatus(t *testing.T) {
+
+	jobs := []CopyJob{{SrcImage: SrcImageNames[0], DstImage: DstImageNames[0]}}
+	statuses := []CopyStatus{{State: CopyPending, BytesCopied: 10, BytesTotal: 20}}
+	deployment := &appsv1.Deployment{}
+
+	assert.True(t, setBackupStatus(deployment, newBackupStatus(jobs, statuses)))
+	assert.False(t, setBackupStatus(deployment, newBackupStatus(jobs, statuses)))
+	assert.JSONEq(t, `{"images":[{"image":"library/image1","destination":"index.docker.io/user/image1","backupDestination":"primary","state":"Pending","bytesCopied":10,"bytesTotal":20}]}`,
+		deployment.Annotations[STATUS_ANNOTATION])
+}
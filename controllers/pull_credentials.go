@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// PULL_CREDENTIALS_SECRET_NAME is the Secret with the pull credentials of the
+// backup registry of a single namespace.
+const PULL_CREDENTIALS_SECRET_NAME = "backup-registry-pull-creds"
+
+// PullCredentials describes the pull secrets of the backup registry created in
+// the namespaces of the workloads. It finds the read-only credentials
+// workloads pull their backup images with, so the push credentials stay in
+// the controller. The Secret PULL_CREDENTIALS_SECRET_NAME in the namespace of
+// a workload wins over the Secret Global. Both hold username and password like
+// the Secret of the push credentials.
+type PullCredentials struct {
+	// Global is the Secret with the pull credentials of all namespaces, none if
+	// its name is empty.
+	Global types.NamespacedName
+	// SecretName is the name of the pull secrets, DESTINATION_SECRET_NAME if
+	// empty.
+	SecretName string
+	// ServiceAccounts attaches the pull secrets to the ServiceAccounts of the
+	// namespaces instead of the pod templates of the workloads.
+	ServiceAccounts bool
+}
+
+func (p *PullCredentials) secretName() string {
+	if p == nil || p.SecretName == "" {
+		return DESTINATION_SECRET_NAME
+	}
+	return p.SecretName
+}
+
+func (p *PullCredentials) serviceAccounts() bool {
+	return p != nil && p.ServiceAccounts
+}
+
+func (p *PullCredentials) isGlobal(obj client.Object) bool {
+	return p != nil && p.Global.Name != "" && obj.GetNamespace() == p.Global.Namespace && obj.GetName() == p.Global.Name
+}
+
+// get returns the pull credentials of namespace for the registry at url, or
+// nil if there are none.
+func (p *PullCredentials) get(ctx context.Context, reader client.Reader, namespace, url string) (*RegistryCredentials, error) {
+	if p == nil {
+		return nil, nil
+	}
+	keys := []types.NamespacedName{{Namespace: namespace, Name: PULL_CREDENTIALS_SECRET_NAME}}
+	if p.Global.Name != "" {
+		keys = append(keys, p.Global)
+	}
+	for _, key := range keys {
+		secret := &corev1.Secret{}
+		if err := reader.Get(ctx, key, secret); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		credentials, err := backupCredentialsFromSecret(secret, url, "")
+		if err != nil {
+			return nil, &PermanentError{Err: err}
+		}
+		return credentials, nil
+	}
+	return nil, nil
+}
+
+// getDestinationSecret returns the pull secret of the backup registry in
+// namespace, labeled as managed by the controller. Without pull credentials it
+// holds the push credentials.
+func getDestinationSecret(ctx context.Context, reader client.Reader, pull *PullCredentials, push *RegistryCredentials, namespace string) (*corev1.Secret, error) {
+	credentials, err := pull.get(ctx, reader, namespace, push.URL)
+	if err != nil {
+		return nil, err
+	}
+	if credentials == nil {
+		credentials = push
+	}
+	secret, err := getDockerConfigSecret(credentials.Username, credentials.Password, credentials.URL)
+	if err != nil {
+		return nil, err
+	}
+	secret.Name = pull.secretName()
+	secret.Namespace = namespace
+	secret.Labels = map[string]string{MANAGED_LABEL: "true"}
+	return secret, nil
+}
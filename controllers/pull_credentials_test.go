@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newPullCredentialsSecret(namespace, name, username, password string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data:       map[string][]byte{"username": []byte(username), "password": []byte(password)},
+	}
+}
+
+func TestGetDestinationSecret(t *testing.T) {
+	ctx := context.Background()
+	push := &RegistryCredentials{URL: "backup.io", Username: "backup", Password: "push-password"}
+	global := types.NamespacedName{Namespace: "image-backup", Name: "pull-creds"}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		newPullCredentialsSecret(global.Namespace, global.Name, "reader", "global-password"),
+		newPullCredentialsSecret("team-a", PULL_CREDENTIALS_SECRET_NAME, "team-a", "team-password"),
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "broken", Name: PULL_CREDENTIALS_SECRET_NAME}},
+	).Build()
+
+	expect := func(t *testing.T, secret *corev1.Secret, username, password string) {
+		expected, err := getDockerConfigSecret(username, password, "backup.io")
+		require.NoError(t, err)
+		assert.Equal(t, DESTINATION_SECRET_NAME, secret.Name)
+		assert.Equal(t, expected.Data, secret.Data)
+	}
+
+	t.Run("push credentials without pull credentials", func(t *testing.T) {
+		secret, err := getDestinationSecret(ctx, k8sClient, nil, push, "apps")
+		require.NoError(t, err)
+		assert.Equal(t, "apps", secret.Namespace)
+		expect(t, secret, "backup", "push-password")
+
+		secret, err = getDestinationSecret(ctx, k8sClient, &PullCredentials{}, push, "apps")
+		require.NoError(t, err)
+		expect(t, secret, "backup", "push-password")
+	})
+
+	t.Run("configured name", func(t *testing.T) {
+		secret, err := getDestinationSecret(ctx, k8sClient, &PullCredentials{SecretName: "backup-creds"}, push, "apps")
+		require.NoError(t, err)
+		assert.Equal(t, "backup-creds", secret.Name)
+		assert.Equal(t, map[string]string{MANAGED_LABEL: "true"}, secret.Labels)
+	})
+
+	t.Run("global pull credentials", func(t *testing.T) {
+		secret, err := getDestinationSecret(ctx, k8sClient, &PullCredentials{Global: global}, push, "apps")
+		require.NoError(t, err)
+		expect(t, secret, "reader", "global-password")
+	})
+
+	t.Run("namespace pull credentials win", func(t *testing.T) {
+		secret, err := getDestinationSecret(ctx, k8sClient, &PullCredentials{Global: global}, push, "team-a")
+		require.NoError(t, err)
+		assert.Equal(t, "team-a", secret.Namespace)
+		expect(t, secret, "team-a", "team-password")
+	})
+
+	t.Run("invalid pull credentials", func(t *testing.T) {
+		_, err := getDestinationSecret(ctx, k8sClient, &PullCredentials{Global: global}, push, "broken")
+		assert.True(t, IsPermanentError(err))
+	})
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PULL_SECRET_ANNOTATION records the pull secret the controller added to
+	// the pod template of a workload, so it never removes one it didn't add.
+	PULL_SECRET_ANNOTATION = "imagebackup.junaidk.io/pull-secret"
+	// MANAGED_LABEL marks the pull secrets the controller created. Secrets
+	// without it are never updated or deleted.
+	MANAGED_LABEL = "imagebackup.junaidk.io/managed"
+	// PULL_SECRET_GC_GRACE_PERIOD keeps unreferenced pull secrets while the
+	// workloads they were created for are rewritten to them.
+	PULL_SECRET_GC_GRACE_PERIOD = time.Minute
+)
+
+func isManagedSecret(obj client.Object) bool {
+	return obj.GetLabels()[MANAGED_LABEL] == "true"
+}
+
+// canUpdateSecret reports whether the existing secret may be replaced by
+// desired. Pull secrets of earlier versions have no label, they are adopted if
+// they have the default name and only hold credentials of the registries of
+// desired.
+func canUpdateSecret(existing, desired *corev1.Secret) bool {
+	if isManagedSecret(existing) {
+		return true
+	}
+	if existing.Name != DESTINATION_SECRET_NAME || existing.Type != desired.Type {
+		return false
+	}
+	existingAuth, err := parseDockerConfig(existing.Data[corev1.DockerConfigJsonKey])
+	if err != nil {
+		return false
+	}
+	desiredAuth, err := parseDockerConfig(desired.Data[corev1.DockerConfigJsonKey])
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(registriesOf(existingAuth), registriesOf(desiredAuth))
+}
+
+func registriesOf(auth *authConfigurations) map[string]bool {
+	registries := make(map[string]bool)
+	for registry := range auth.Configs {
+		registries[registry] = true
+	}
+	return registries
+}
+
+// listPodSpecs returns the pod templates of the Deployments and DaemonSets in
+// namespace.
+func listPodSpecs(ctx context.Context, reader client.Reader, namespace string) ([]*corev1.PodSpec, error) {
+	deployments := &appsv1.DeploymentList{}
+	if err := reader.List(ctx, deployments, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	daemonsets := &appsv1.DaemonSetList{}
+	if err := reader.List(ctx, daemonsets, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+
+	podSpecs := make([]*corev1.PodSpec, 0, len(deployments.Items)+len(daemonsets.Items))
+	for i := range deployments.Items {
+		podSpecs = append(podSpecs, &deployments.Items[i].Spec.Template.Spec)
+	}
+	for i := range daemonsets.Items {
+		podSpecs = append(podSpecs, &daemonsets.Items[i].Spec.Template.Spec)
+	}
+	return podSpecs, nil
+}
+
+// isPullSecretReferenced reports whether a Deployment or DaemonSet in
+// namespace references the pull secret name.
+func isPullSecretReferenced(ctx context.Context, reader client.Reader, namespace, name string) (bool, error) {
+	podSpecs, err := listPodSpecs(ctx, reader, namespace)
+	if err != nil {
+		return false, err
+	}
+	for _, podSpec := range podSpecs {
+		if referencesPullSecret(podSpec.ImagePullSecrets, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isRegistryUsed reports whether a Deployment or DaemonSet in namespace runs
+// an image of the registry at url.
+func isRegistryUsed(ctx context.Context, reader client.Reader, namespace, url string) (bool, error) {
+	podSpecs, err := listPodSpecs(ctx, reader, namespace)
+	if err != nil {
+		return false, err
+	}
+	for _, podSpec := range podSpecs {
+		for _, container := range podSpec.Containers {
+			if strings.Contains(container.Image, url) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func referencesPullSecret(refs []corev1.LocalObjectReference, name string) bool {
+	for _, ref := range refs {
+		if ref.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addPullSecret adds the pull secret name to refs, the pull secrets of the pod
+// template or ServiceAccount obj, behind the existing ones. A pull secret
+// added for another name before is removed.
+func addPullSecret(obj client.Object, refs *[]corev1.LocalObjectReference, name string) {
+	if added, ok := obj.GetAnnotations()[PULL_SECRET_ANNOTATION]; ok && added != name {
+		removePullSecret(obj, refs)
+	}
+	if referencesPullSecret(*refs, name) {
+		return
+	}
+	*refs = append(*refs, corev1.LocalObjectReference{Name: name})
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[PULL_SECRET_ANNOTATION] = name
+	obj.SetAnnotations(annotations)
+}
+
+// removePullSecret removes the pull secret addPullSecret added to refs of obj,
+// the other pull secrets are kept.
+func removePullSecret(obj client.Object, refs *[]corev1.LocalObjectReference) {
+	annotations := obj.GetAnnotations()
+	name, ok := annotations[PULL_SECRET_ANNOTATION]
+	if !ok {
+		return
+	}
+	var kept []corev1.LocalObjectReference
+	for _, ref := range *refs {
+		if ref.Name != name {
+			kept = append(kept, ref)
+		}
+	}
+	*refs = kept
+
+	delete(annotations, PULL_SECRET_ANNOTATION)
+	obj.SetAnnotations(annotations)
+}
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestAddPullSecret(t *testing.T) {
+	deployment := newE2EDeployment("docker.io/app:1", "src-creds", "sidecar-creds")
+	refs := &deployment.Spec.Template.Spec.ImagePullSecrets
+
+	addPullSecret(deployment, refs, DESTINATION_SECRET_NAME)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "src-creds"}, {Name: "sidecar-creds"}, {Name: DESTINATION_SECRET_NAME}}, *refs)
+	assert.Equal(t, DESTINATION_SECRET_NAME, deployment.Annotations[PULL_SECRET_ANNOTATION])
+
+	// adding it again changes nothing
+	addPullSecret(deployment, refs, DESTINATION_SECRET_NAME)
+	assert.Len(t, *refs, 3)
+
+	// a renamed pull secret replaces the one added before
+	addPullSecret(deployment, refs, "backup-creds")
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "src-creds"}, {Name: "sidecar-creds"}, {Name: "backup-creds"}}, *refs)
+
+	removePullSecret(deployment, refs)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "src-creds"}, {Name: "sidecar-creds"}}, *refs)
+	assert.NotContains(t, deployment.Annotations, PULL_SECRET_ANNOTATION)
+}
+
+func TestRemovePullSecretKeepsForeignEntries(t *testing.T) {
+	// the workload referenced the pull secret before the controller did
+	deployment := newE2EDeployment("docker.io/app:1", DESTINATION_SECRET_NAME)
+	refs := &deployment.Spec.Template.Spec.ImagePullSecrets
+
+	addPullSecret(deployment, refs, DESTINATION_SECRET_NAME)
+	assert.NotContains(t, deployment.Annotations, PULL_SECRET_ANNOTATION)
+
+	removePullSecret(deployment, refs)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: DESTINATION_SECRET_NAME}}, *refs)
+
+	removePullSecret(&appsv1.DaemonSet{}, &[]corev1.LocalObjectReference{})
+}
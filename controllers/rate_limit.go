@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DEFAULT_THROTTLE_PAUSE is how long copies from or to a registry are held
+	// back after it answered 429 Too Many Requests without a Retry-After.
+	// containers/image waits for the Retry-After of each throttled request
+	// itself and doesn't return it when it gives up, so its copies are always
+	// held back this long.
+	DEFAULT_THROTTLE_PAUSE = time.Minute
+)
+
+// RegistryRateLimiter is a token bucket per registry host. Every image copy
+// takes one token from the bucket of its source and destination registry,
+// inspecting the size of an image one from the bucket of its source.
+type RegistryRateLimiter struct {
+	config *RegistryConfig
+
+	mu          sync.Mutex
+	limiters    map[string]*rate.Limiter
+	pausedUntil map[string]time.Time
+}
+
+func NewRegistryRateLimiter(config *RegistryConfig) *RegistryRateLimiter {
+	return &RegistryRateLimiter{
+		config:      config,
+		limiters:    make(map[string]*rate.Limiter),
+		pausedUntil: make(map[string]time.Time),
+	}
+}
+
+// Wait blocks until a copy from or to host may start.
+func (l *RegistryRateLimiter) Wait(ctx context.Context, host string) error {
+	host = normalizeRegistryHost(host)
+	start := time.Now()
+	defer func() {
+		rateLimitWaitSeconds.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	}()
+
+	l.mu.Lock()
+	limiter := l.limiter(host)
+	pause := time.Until(l.pausedUntil[host])
+	l.mu.Unlock()
+
+	if pause > 0 {
+		timer := time.NewTimer(pause)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
+
+// Pause holds back copies from or to host for d.
+func (l *RegistryRateLimiter) Pause(host string, d time.Duration) {
+	host = normalizeRegistryHost(host)
+	registryThrottledTotal.WithLabelValues(host).Inc()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil[host]) {
+		l.pausedUntil[host] = until
+	}
+}
+
+// waitForCopy blocks until both the source and the destination registry
+// allow another copy. An empty dstHost is not limited.
+func (l *RegistryRateLimiter) waitForCopy(ctx context.Context, srcHost, dstHost string) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.Wait(ctx, srcHost); err != nil {
+		return err
+	}
+	if dstHost == "" || dstHost == srcHost {
+		return nil
+	}
+	return l.Wait(ctx, dstHost)
+}
+
+// retryAfter returns how long the Retry-After header of a 429 response asks
+// to wait, given in seconds or as an HTTP date, or fallback if it is missing
+// or invalid.
+func retryAfter(header http.Header, fallback time.Duration) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return fallback
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// limiter returns the token bucket of host, or nil if host is not limited.
+// Must be called with l.mu held.
+func (l *RegistryRateLimiter) limiter(host string) *rate.Limiter {
+	if limiter, ok := l.limiters[host]; ok {
+		return limiter
+	}
+
+	var limiter *rate.Limiter
+	if rateLimit := l.config.hostConfig(host).RateLimit; rateLimit != nil {
+		burst := rateLimit.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(rateLimit.CopiesPerMinute/60), burst)
+	}
+	l.limiters[host] = limiter
+	return limiter
+}
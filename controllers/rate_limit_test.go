@@ -0,0 +1,53 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryRateLimiter(t *testing.T) {
+
+	limiter := NewRegistryRateLimiter(&RegistryConfig{
+		Registries: map[string]RegistryHostConfig{
+			"docker.io": {RateLimit: &RateLimitConfig{CopiesPerMinute: 1, Burst: 1}},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	// the first copy uses the burst, the second one has to wait a minute
+	assert.NoError(t, limiter.Wait(ctx, registryHost("library/nginx")))
+	assert.Error(t, limiter.Wait(ctx, "index.docker.io"))
+
+	// registries without a limit are not throttled
+	assert.NoError(t, limiter.Wait(ctx, "quay.io"))
+	assert.NoError(t, limiter.Wait(ctx, "quay.io"))
+
+	limiter.Pause("quay.io", time.Minute)
+	assert.Error(t, limiter.Wait(ctx, "quay.io"))
+}
+
+func TestRetryAfter(t *testing.T) {
+
+	header := http.Header{}
+	assert.Equal(t, time.Minute, retryAfter(header, time.Minute))
+	header.Set("Retry-After", "30")
+	assert.Equal(t, time.Second*30, retryAfter(header, time.Minute))
+	header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, float64(time.Hour), float64(retryAfter(header, time.Minute)), float64(time.Second*5))
+	header.Set("Retry-After", "soon")
+	assert.Equal(t, time.Minute, retryAfter(header, time.Minute))
+}
+
+func TestRegistryHost(t *testing.T) {
+
+	assert.Equal(t, "docker.io", registryHost("nginx"))
+	assert.Equal(t, "docker.io", registryHost("index.docker.io/user/image1"))
+	assert.Equal(t, "quay.io", registryHost("quay.io/notcache/image2"))
+	assert.Equal(t, "registry.local:5000", registryHost("registry.local:5000/app:v1"))
+}
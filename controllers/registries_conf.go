@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/docker/distribution/reference"
+)
+
+// registriesConf holds the [[registry]] tables of a registries.conf file in
+// the v2 format of containers-registries.conf(5), the part that decides where
+// images are pulled from. ContainerRegistryManager reads the same file with
+// containers/image, DistributionRegistryManager reads it with this, so it
+// doesn't depend on containers/image.
+type registriesConf struct {
+	Registries []registriesConfRegistry `toml:"registry"`
+}
+
+type registriesConfEndpoint struct {
+	Location string `toml:"location"`
+	Insecure bool   `toml:"insecure"`
+}
+
+type registriesConfRegistry struct {
+	// Prefix matches the images of the registry, it defaults to Location.
+	// "*.example.com" matches the images of all subdomains.
+	Prefix string `toml:"prefix"`
+	registriesConfEndpoint
+	Mirrors []registriesConfEndpoint `toml:"mirror"`
+	Blocked bool                     `toml:"blocked"`
+	// MirrorByDigestOnly only pulls images referenced by digest from mirrors.
+	MirrorByDigestOnly bool `toml:"mirror-by-digest-only"`
+}
+
+// loadRegistriesConf reads the registries.conf file at path, an empty path
+// has no registries.
+func loadRegistriesConf(path string) (*registriesConf, error) {
+	conf := &registriesConf{}
+	if path == "" {
+		return conf, nil
+	}
+	meta, err := toml.DecodeFile(path, conf)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsDefined("registries") {
+		return nil, fmt.Errorf("the v1 format of registries.conf is not supported")
+	}
+
+	for i := range conf.Registries {
+		registry := &conf.Registries[i]
+		if registry.Location, err = parseRegistriesConfLocation(registry.Location); err != nil {
+			return nil, err
+		}
+		if registry.Prefix == "" {
+			if registry.Location == "" {
+				return nil, fmt.Errorf("registry has neither a location nor a prefix")
+			}
+			registry.Prefix = registry.Location
+		} else if registry.Prefix, err = parseRegistriesConfLocation(registry.Prefix); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(registry.Prefix, "*.") {
+			if strings.ContainsAny(registry.Prefix, "/@:") {
+				return nil, fmt.Errorf("wildcard prefix %s must have the format *.example.com", registry.Prefix)
+			}
+		} else if registry.Location == "" {
+			return nil, fmt.Errorf("registry %s has no location", registry.Prefix)
+		}
+		for j := range registry.Mirrors {
+			mirror := &registry.Mirrors[j]
+			if mirror.Location, err = parseRegistriesConfLocation(mirror.Location); err != nil {
+				return nil, err
+			}
+			if mirror.Location == "" {
+				return nil, fmt.Errorf("mirror of registry %s has no location", registry.Prefix)
+			}
+		}
+	}
+	return conf, nil
+}
+
+func parseRegistriesConfLocation(location string) (string, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return "", fmt.Errorf("invalid location %s: URI schemes are not supported", location)
+	}
+	return strings.TrimRight(location, "/"), nil
+}
+
+// findRegistry returns the registry with the longest prefix matching name, the
+// first one if several have it, or nil if none matches.
+func (c *registriesConf) findRegistry(name string) *registriesConfRegistry {
+	var found *registriesConfRegistry
+	for i := range c.Registries {
+		registry := &c.Registries[i]
+		if matchRegistriesConfPrefix(name, registry.Prefix) == -1 {
+			continue
+		}
+		if found == nil || len(registry.Prefix) > len(found.Prefix) {
+			found = registry
+		}
+	}
+	return found
+}
+
+// pullSources returns the mirrors and the location of the registry to pull
+// named from, in this order.
+func (r *registriesConfRegistry) pullSources(named reference.Named) ([]pullSource, error) {
+	endpoints := []registriesConfEndpoint{r.registriesConfEndpoint}
+	if _, digested := named.(reference.Digested); digested || !r.MirrorByDigestOnly {
+		endpoints = append(append([]registriesConfEndpoint{}, r.Mirrors...), r.registriesConfEndpoint)
+	}
+
+	sources := make([]pullSource, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		source := named
+		// wildcard prefixes have no location, their images are pulled as is
+		if endpoint.Location != "" {
+			ref := named.String()
+			prefixLen := matchRegistriesConfPrefix(ref, r.Prefix)
+			if prefixLen == -1 {
+				return nil, fmt.Errorf("invalid prefix %s for %s", r.Prefix, ref)
+			}
+			rewritten, err := reference.ParseNamed(endpoint.Location + ref[prefixLen:])
+			if err != nil {
+				return nil, permanentErrorf("invalid pull source %s: %v", endpoint.Location+ref[prefixLen:], err)
+			}
+			source = rewritten
+		}
+		sources = append(sources, pullSource{named: source, insecure: endpoint.Insecure})
+	}
+	return sources, nil
+}
+
+// matchRegistriesConfPrefix returns the length of the part of ref matched by
+// prefix, or -1 if it doesn't match. Like in containers/image a prefix matches
+// whole path components, tags and digests.
+func matchRegistriesConfPrefix(ref, prefix string) int {
+	if strings.HasPrefix(prefix, "*.") {
+		domain := strings.SplitN(ref, "/", 2)[0]
+		index := strings.Index(domain, prefix[1:])
+		if index == -1 {
+			return -1
+		}
+		prefix = ref[:index+len(prefix)-1]
+	}
+	if !strings.HasPrefix(ref, prefix) {
+		return -1
+	}
+	if len(ref) == len(prefix) {
+		return len(prefix)
+	}
+	switch ref[len(prefix)] {
+	case '/', ':', '@':
+		return len(prefix)
+	}
+	return -1
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistributionPullSources(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "registries.conf")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+unqualified-search-registries = ["docker.io"]
+
+[[registry]]
+prefix = "docker.io"
+location = "docker.io"
+
+[[registry.mirror]]
+location = "dockerhub-mirror.internal/hub"
+insecure = true
+
+[[registry]]
+prefix = "quay.io/team"
+location = "quay-mirror.internal/team"
+mirror-by-digest-only = true
+
+[[registry.mirror]]
+location = "cache.internal/quay"
+
+[[registry]]
+prefix = "*.blocked.io"
+blocked = true
+`), 0600))
+	d := &DistributionRegistryManager{RegistriesConfPath: path}
+
+	pullSources := func(image string) []string {
+		sources, err := d.pullSources(image)
+		require.NoError(t, err)
+		var names []string
+		for _, source := range sources {
+			names = append(names, source.named.String())
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"dockerhub-mirror.internal/hub/library/nginx:1.21", "docker.io/library/nginx:1.21"}, pullSources("nginx:1.21"))
+	sources, err := d.pullSources("nginx")
+	require.NoError(t, err)
+	assert.True(t, sources[0].insecure)
+	assert.False(t, sources[1].insecure)
+
+	// mirrors are only used for digests
+	assert.Equal(t, []string{"quay-mirror.internal/team/app:1"}, pullSources("quay.io/team/app:1"))
+	digest := "@" + sha256Digest(nil)
+	assert.Equal(t, []string{"cache.internal/quay/app" + digest, "quay-mirror.internal/team/app" + digest}, pullSources("quay.io/team/app"+digest))
+	// prefixes match whole path components
+	assert.Equal(t, []string{"quay.io/teams/app:1"}, pullSources("quay.io/teams/app:1"))
+
+	_, err = d.pullSources("registry.blocked.io/app:1")
+	assert.True(t, IsPermanentError(err))
+}
+
+func TestLoadRegistriesConfErrors(t *testing.T) {
+
+	invalid := []string{
+		"[[registry]]\nlocation = \"https://quay.io\"\n",
+		"[[registry]]\ninsecure = true\n",
+		"[[registry]]\nprefix = \"*.example.com/team\"\n",
+		"[[registry]]\nlocation = \"quay.io\"\n[[registry.mirror]]\ninsecure = true\n",
+		"[registries.search]\nregistries = [\"docker.io\"]\n",
+	}
+	for _, conf := range invalid {
+		path := filepath.Join(t.TempDir(), "registries.conf")
+		require.NoError(t, ioutil.WriteFile(path, []byte(conf), 0600))
+		_, err := loadRegistriesConf(path)
+		assert.Error(t, err, conf)
+	}
+
+	conf, err := loadRegistriesConf("")
+	assert.NoError(t, err)
+	assert.Nil(t, conf.findRegistry("docker.io/library/nginx"))
+}
@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"context"
+)
+
+type RegistryManager interface {
+	CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstCredentials *RegistryCredentials) error
+	// ImageSize returns the size of the config and layers of srcImage as
+	// listed in its manifest.
+	ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error)
+}
+
+type RegistryCredentials struct {
+	URL      string
+	Username string
+	Password string
+	// IdentityToken is an OAuth refresh token exchanged for access tokens
+	// instead of the password.
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is.
+	RegistryToken string
+}
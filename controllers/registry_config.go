@@ -0,0 +1,134 @@
+package controllers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"sigs.k8s.io/yaml"
+)
+
+// RegistryConfig holds per registry settings keyed by registry host, e.g.
+//
+//	registries:
+//	  docker.io:
+//	    rateLimit:
+//	      copiesPerMinute: 30
+//	      burst: 5
+//	  registry.internal:5000:
+//	    tls:
+//	      certDir: /etc/image-backup/certs/registry.internal
+//	destinations:
+//	- name: offsite
+//	  url: offsite.example.com
+//	  username: backup
+//	  passwordFile: /etc/image-backup/offsite/password
+type RegistryConfig struct {
+	Registries map[string]RegistryHostConfig `json:"registries,omitempty"`
+	// Destinations are registries images are replicated to besides the
+	// primary backup registry.
+	Destinations []DestinationConfig `json:"destinations,omitempty"`
+}
+
+type RegistryHostConfig struct {
+	// RateLimit limits how many images are copied from or to the registry.
+	RateLimit *RateLimitConfig `json:"rateLimit,omitempty"`
+	// TLS configures the connection to the registry.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// Credentials obtains the registry credentials from a credential helper,
+	// they take precedence over pull secrets and BACKUP_REGISTRY_PASSWORD.
+	Credentials *CredentialsConfig `json:"credentials,omitempty"`
+}
+
+type TLSConfig struct {
+	// CertDir holds the CA bundle (*.crt) and client certificate pair
+	// (*.cert and *.key) of the registry, in the layout of docker's certs.d.
+	CertDir string `json:"certDir,omitempty"`
+	// Insecure skips TLS verification and falls back to plain HTTP if the
+	// registry doesn't serve HTTPS.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+type RateLimitConfig struct {
+	// CopiesPerMinute is the sustained number of image copies started per minute.
+	CopiesPerMinute float64 `json:"copiesPerMinute"`
+	// Burst is the number of copies that may start at once, defaults to 1.
+	Burst int `json:"burst,omitempty"`
+}
+
+func LoadRegistryConfig(path string) (*RegistryConfig, error) {
+	config := &RegistryConfig{}
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry config: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse registry config %s: %v", path, err)
+	}
+
+	registries := make(map[string]RegistryHostConfig, len(config.Registries))
+	for host, hostConfig := range config.Registries {
+		if hostConfig.RateLimit != nil && hostConfig.RateLimit.CopiesPerMinute <= 0 {
+			return nil, fmt.Errorf("registry %s: rateLimit.copiesPerMinute must be positive", host)
+		}
+		if hostConfig.TLS != nil && hostConfig.TLS.CertDir != "" {
+			if info, err := os.Stat(hostConfig.TLS.CertDir); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("registry %s: tls.certDir %s is not a directory", host, hostConfig.TLS.CertDir)
+			}
+		}
+		if hostConfig.Credentials != nil {
+			if err := hostConfig.Credentials.validate(); err != nil {
+				return nil, fmt.Errorf("registry %s: credentials: %v", host, err)
+			}
+		}
+		registries[normalizeRegistryHost(host)] = hostConfig
+	}
+	config.Registries = registries
+
+	return config, nil
+}
+
+// ValidateRegistriesConf checks that the registries.conf file at path exists
+// and can be parsed. The file configures mirrors for the source registries.
+func ValidateRegistriesConf(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to read registries.conf: %v", err)
+	}
+	if _, err := loadRegistriesConf(path); err != nil {
+		return fmt.Errorf("failed to parse registries.conf %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *RegistryConfig) hostConfig(host string) RegistryHostConfig {
+	if c == nil {
+		return RegistryHostConfig{}
+	}
+	return c.Registries[normalizeRegistryHost(host)]
+}
+
+// registryHost returns the normalized registry host of an image reference.
+func registryHost(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return normalizeRegistryHost(strings.Split(image, "/")[0])
+	}
+	return normalizeRegistryHost(reference.Domain(named))
+}
+
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.TrimSuffix(host, "/")
+	switch host {
+	case DEFAULT_DOCKER_REGISTRY, "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRegistryConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "registries.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0600))
+	return path
+}
+
+func TestLoadRegistryConfig(t *testing.T) {
+
+	certDir := t.TempDir()
+	path := writeRegistryConfig(t, `
+registries:
+  index.docker.io:
+    rateLimit:
+      copiesPerMinute: 30
+  registry.internal:5000:
+    tls:
+      certDir: `+certDir+`
+  lab.local:
+    tls:
+      insecure: true
+`)
+	config, err := LoadRegistryConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(30), config.hostConfig("docker.io").RateLimit.CopiesPerMinute)
+	assert.Equal(t, certDir, config.hostConfig("registry.internal:5000").TLS.CertDir)
+	assert.True(t, config.hostConfig("lab.local").TLS.Insecure)
+	assert.Nil(t, config.hostConfig("quay.io").TLS)
+}
+
+func TestLoadRegistryConfigErrors(t *testing.T) {
+
+	_, err := LoadRegistryConfig(writeRegistryConfig(t, `
+registries:
+  quay.io:
+    rateLimit:
+      copiesPerMinute: 0
+`))
+	assert.Error(t, err)
+
+	_, err = LoadRegistryConfig(writeRegistryConfig(t, `
+registries:
+  quay.io:
+    tls:
+      certDir: `+filepath.Join(os.TempDir(), "does-not-exist")+`
+`))
+	assert.Error(t, err)
+
+	config, err := LoadRegistryConfig("")
+	assert.NoError(t, err)
+	assert.Nil(t, config.hostConfig("quay.io").TLS)
+}
+
+func TestValidateRegistriesConf(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "registries.conf")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`
+[[registry]]
+prefix = "docker.io"
+location = "docker.io"
+
+[[registry.mirror]]
+location = "dockerhub-mirror.internal"
+`), 0600))
+	assert.NoError(t, ValidateRegistriesConf(path))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`[[registry]`), 0600))
+	assert.Error(t, ValidateRegistriesConf(path))
+
+	assert.Error(t, ValidateRegistriesConf(filepath.Join(t.TempDir(), "missing.conf")))
+}
@@ -1,18 +1,27 @@
 package controllers
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// DESTINATION_SECRET_NAME is the pull secret of the backup registry created in
+// the namespace of every workload.
+const DESTINATION_SECRET_NAME = "destination-registry-creds"
+
 type authConfiguration struct {
 	Username      string `json:"username,omitempty"`
 	Password      string `json:"password,omitempty"`
 	Email         string `json:"email,omitempty"`
 	ServerAddress string `json:"serveraddress,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
 }
 
 type authConfigurations struct {
@@ -20,9 +29,15 @@ type authConfigurations struct {
 }
 
 type dockerConfig struct {
+	// Auth is the base64 encoded "username:password", it is what kubectl
+	// create secret docker-registry writes.
 	Auth     string `json:"auth"`
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+	// IdentityToken is an OAuth refresh token used instead of the password,
+	// RegistryToken a bearer token sent to the registry as is.
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
 }
 
 // code snippet taken from https://github.com/fsouza/go-dockerclient/blob/main/auth.go
@@ -33,15 +48,38 @@ func parseDockerConfig(dockerCfg []byte) (*authConfigurations, error) {
 	if err := json.Unmarshal(dockerCfg, &confsWrapper); err != nil {
 		return nil, fmt.Errorf("failed to parse docker config: %v", err)
 	}
+	return newAuthConfigurations(confsWrapper.Auths)
+}
+
+// parseLegacyDockerConfig parses the .dockercfg format of
+// kubernetes.io/dockercfg secrets, the auths map without the wrapper.
+func parseLegacyDockerConfig(dockerCfg []byte) (*authConfigurations, error) {
+	var auths map[string]dockerConfig
+	if err := json.Unmarshal(dockerCfg, &auths); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config: %v", err)
+	}
+	return newAuthConfigurations(auths)
+}
 
+func newAuthConfigurations(auths map[string]dockerConfig) (*authConfigurations, error) {
 	c := &authConfigurations{
 		Configs: make(map[string]authConfiguration),
 	}
-	for reg, conf := range confsWrapper.Auths {
+	for reg, conf := range auths {
 		authConfig := authConfiguration{
-			Username:      conf.Username, //userpass[0],
-			Password:      conf.Password, //userpass[1],
+			Username:      conf.Username,
+			Password:      conf.Password,
 			ServerAddress: reg,
+			IdentityToken: conf.IdentityToken,
+			RegistryToken: conf.RegistryToken,
+		}
+		// like docker, auth takes precedence over username and password
+		if conf.Auth != "" {
+			username, password, err := decodeDockerConfigAuth(conf.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse auth of %s: %v", reg, err)
+			}
+			authConfig.Username, authConfig.Password = username, password
 		}
 
 		c.Configs[reg] = authConfig
@@ -50,23 +88,55 @@ func parseDockerConfig(dockerCfg []byte) (*authConfigurations, error) {
 	return c, nil
 }
 
-func getRegistryCredentialsFromDockerCfg(dockerCfg []byte) (*RegistryCredentials, error) {
-	var auth *authConfigurations
+// decodeDockerConfigAuth decodes the base64 "username:password" of the auth
+// field of a docker config.
+func decodeDockerConfigAuth(auth string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth))
+	if err != nil {
+		return "", "", err
+	}
+	userpass := strings.SplitN(string(decoded), ":", 2)
+	if len(userpass) != 2 {
+		return "", "", fmt.Errorf("invalid auth, expected username:password")
+	}
+	return userpass[0], userpass[1], nil
+}
+
+// getRegistryCredentialsFromDockerCfg returns the credentials of every
+// registry in a docker config, sorted by registry.
+func getRegistryCredentialsFromDockerCfg(dockerCfg []byte) ([]*RegistryCredentials, error) {
 	auth, err := parseDockerConfig(dockerCfg)
 	if err != nil {
 		return nil, err
 	}
+	return registryCredentialsFromAuth(auth), nil
+}
 
-	var regCreds RegistryCredentials
-	for k, v := range auth.Configs {
-		regCreds = RegistryCredentials{
-			URL:      k,
-			Username: v.Username,
-			Password: v.Password,
-		}
+// getRegistryCredentialsFromLegacyDockerCfg is
+// getRegistryCredentialsFromDockerCfg for the legacy .dockercfg format.
+func getRegistryCredentialsFromLegacyDockerCfg(dockerCfg []byte) ([]*RegistryCredentials, error) {
+	auth, err := parseLegacyDockerConfig(dockerCfg)
+	if err != nil {
+		return nil, err
 	}
+	return registryCredentialsFromAuth(auth), nil
+}
 
-	return &regCreds, nil
+func registryCredentialsFromAuth(auth *authConfigurations) []*RegistryCredentials {
+	regCreds := make([]*RegistryCredentials, 0, len(auth.Configs))
+	for k, v := range auth.Configs {
+		regCreds = append(regCreds, &RegistryCredentials{
+			URL:           k,
+			Username:      v.Username,
+			Password:      v.Password,
+			IdentityToken: v.IdentityToken,
+			RegistryToken: v.RegistryToken,
+		})
+	}
+	sort.Slice(regCreds, func(i, j int) bool {
+		return regCreds[i].URL < regCreds[j].URL
+	})
+	return regCreds
 }
 
 func getDockerConfigSecret(username, password, registryUrl string) (*corev1.Secret, error) {
@@ -94,7 +164,7 @@ func getDockerConfigSecret(username, password, registryUrl string) (*corev1.Secr
 	}
 
 	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{Name: "destination-registry-creds"},
+		ObjectMeta: metav1.ObjectMeta{Name: DESTINATION_SECRET_NAME},
 		Immutable:  nil,
 		Data: map[string][]byte{
 			".dockerconfigjson": encodedDockerConfig,
@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestGetAuthFromDockerCfg(t *testing.T) {
@@ -21,8 +26,90 @@ func TestGetAuthFromDockerCfg(t *testing.T) {
 
 	assert.NoError(t, err)
 
-	assert.Equal(t, creds.Username, "junaidk")
-	assert.Equal(t, creds.Password, "abcxd")
+	assert.Len(t, creds, 1)
+	assert.Equal(t, creds[0].Username, "junaidk")
+	assert.Equal(t, creds[0].Password, "abcxd")
+}
+
+func TestGetAuthFromDockerCfgAuthField(t *testing.T) {
+
+	// written by kubectl create secret docker-registry
+	creds, err := getRegistryCredentialsFromDockerCfg([]byte(`{"auths":{"quay.io":{"auth":"cm9ib3Q6cGE6c3M="}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*RegistryCredentials{{URL: "quay.io", Username: "robot", Password: "pa:ss"}}, creds)
+
+	_, err = getRegistryCredentialsFromDockerCfg([]byte(`{"auths":{"quay.io":{"auth":"not base64"}}}`))
+	assert.Error(t, err)
+}
+
+func TestGetTokensFromDockerCfg(t *testing.T) {
+
+	creds, err := getRegistryCredentialsFromDockerCfg([]byte(`{"auths":{"myregistry.azurecr.io":{"auth":"MDAwMDAwMDAtMDAwMC0wMDAwLTAwMDAtMDAwMDAwMDAwMDAwOg==","identitytoken":"refresh-token"}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000000", creds[0].Username)
+	assert.Equal(t, "refresh-token", creds[0].IdentityToken)
+
+	creds, err = getRegistryCredentialsFromDockerCfg([]byte(`{"auths":{"registry.example.com":{"registrytoken":"bearer-token"}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*RegistryCredentials{{URL: "registry.example.com", RegistryToken: "bearer-token"}}, creds)
+}
+
+func TestGetAllEntriesFromDockerCfg(t *testing.T) {
+
+	creds, err := getRegistryCredentialsFromDockerCfg([]byte(`{"auths":{
+		"https://index.docker.io/v1/":{"username":"hub","password":"hub-password"},
+		"ghcr.io":{"username":"gh","password":"gh-password"}}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*RegistryCredentials{
+		{URL: "ghcr.io", Username: "gh", Password: "gh-password"},
+		{URL: "https://index.docker.io/v1/", Username: "hub", Password: "hub-password"},
+	}, creds)
+}
+
+func TestGetAuthFromLegacyDockerCfg(t *testing.T) {
+
+	creds, err := getRegistryCredentialsFromLegacyDockerCfg([]byte(`{
+		"quay.io": {"auth": "cm9ib3Q6cGE6c3M=", "email": "robot@example.com"},
+		"https://index.docker.io/v1/": {"username": "hub", "password": "hub-password"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*RegistryCredentials{
+		{URL: "https://index.docker.io/v1/", Username: "hub", Password: "hub-password"},
+		{URL: "quay.io", Username: "robot", Password: "pa:ss"},
+	}, creds)
+}
+
+func TestGetRegistryCredentialSecretTypes(t *testing.T) {
+
+	newSecret := func(name string, secretType corev1.SecretType, key, data string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Type:       secretType,
+			Data:       map[string][]byte{key: []byte(data)},
+		}
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		newSecret("dockerconfigjson", corev1.SecretTypeDockerConfigJson, corev1.DockerConfigJsonKey, `{"auths":{"quay.io":{"auth":"cm9ib3Q6cGE6c3M="}}}`),
+		newSecret("dockercfg", corev1.SecretTypeDockercfg, corev1.DockerConfigKey, `{"quay.io":{"auth":"cm9ib3Q6cGE6c3M="}}`),
+		newSecret("opaque", corev1.SecretTypeOpaque, "password", "secret"),
+		newSecret("missing-key", corev1.SecretTypeDockercfg, corev1.DockerConfigJsonKey, `{}`),
+	).Build()
+	ctx := context.Background()
+
+	for _, name := range []string{"dockerconfigjson", "dockercfg"} {
+		creds, err := getRegistryCredential(ctx, k8sClient, name, "default")
+		assert.NoError(t, err)
+		assert.Equal(t, []*RegistryCredentials{{URL: "quay.io", Username: "robot", Password: "pa:ss"}}, creds, name)
+	}
+
+	for _, name := range []string{"opaque", "missing-key"} {
+		_, err := getRegistryCredential(ctx, k8sClient, name, "default")
+		assert.True(t, IsPermanentError(err), name)
+	}
+
+	// a missing secret may still be created
+	_, err := getRegistryCredential(ctx, k8sClient, "not-found", "default")
+	assert.Error(t, err)
+	assert.False(t, IsPermanentError(err))
 }
 
 func TestGetDockerCfgSecret(t *testing.T) {
@@ -34,3 +121,51 @@ func TestGetDockerCfgSecret(t *testing.T) {
 
 	assert.JSONEqf(t, string(expected), string(out.Data[".dockerconfigjson"]), "Expected %s to be %s", string(out.Data[".dockerconfigjson"]), string(expected))
 }
+
+func TestGetRegistryCredentialsServiceAccount(t *testing.T) {
+
+	newSecret := func(name, dockerCfg string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(dockerCfg)},
+		}
+	}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		newSecret("pod-quay", `{"auths":{"quay.io":{"username":"pod","password":"pod-password"}}}`),
+		newSecret("sa-quay", `{"auths":{"quay.io":{"username":"sa","password":"sa-password"}}}`),
+		newSecret("sa-ghcr", `{"auths":{"ghcr.io":{"username":"sa","password":"sa-password"}}}`),
+		newSecret("default-ghcr", `{"auths":{"ghcr.io":{"username":"default","password":"default-password"}}}`),
+		newSecret("malformed", `{"auths":`),
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "sa-quay"}, {Name: "sa-ghcr"}, {Name: "deleted"}, {Name: "malformed"}},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "default", Namespace: "default"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "default-ghcr"}},
+		},
+	).Build()
+	ctx := context.Background()
+
+	// the pull secrets of the pod win over those of its ServiceAccount
+	// malformed secrets are skipped like the kubelet does
+	keyring, invalid, err := getRegistryCredentials(ctx, k8sClient, &corev1.PodSpec{
+		ServiceAccountName: "app",
+		ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "pod-quay"}},
+	}, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "pod", keyring.lookup("quay.io/app").Username)
+	assert.Equal(t, "sa", keyring.lookup("ghcr.io/app").Username)
+	assert.Len(t, invalid, 1)
+
+	// without a ServiceAccount the default one is used
+	keyring, invalid, err = getRegistryCredentials(ctx, k8sClient, &corev1.PodSpec{}, "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", keyring.lookup("ghcr.io/app").Username)
+	assert.Empty(t, invalid)
+
+	keyring, _, err = getRegistryCredentials(ctx, k8sClient, &corev1.PodSpec{ServiceAccountName: "missing"}, "default")
+	assert.NoError(t, err)
+	assert.Nil(t, keyring.lookup("ghcr.io/app"))
+}
@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// registryManagerFactories build every RegistryManager backend against the
+// test registries. Backends behind build tags add themselves.
+var registryManagerFactories = map[string]func(config *RegistryConfig, t *testing.T) RegistryManager{
+	REGISTRY_BACKEND_DISTRIBUTION: func(config *RegistryConfig, t *testing.T) RegistryManager {
+		return &DistributionRegistryManager{
+			RegistryConfig: config,
+			RetryPolicy:    RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		}
+	},
+}
+
+// testRegistryConfig trusts the CA of the test registries.
+func testRegistryConfig(t *testing.T, registries ...*testRegistry) *RegistryConfig {
+	certDir := registries[0].CertDir(t)
+	config := &RegistryConfig{Registries: make(map[string]RegistryHostConfig)}
+	for _, registry := range registries {
+		config.Registries[registry.Host] = RegistryHostConfig{TLS: &TLSConfig{CertDir: certDir}}
+	}
+	return config
+}
+
+// e2eHarness runs a copy queue with a real registry manager for a reconciler.
+type e2eHarness struct {
+	client     client.Client
+	queue      *CopyQueue
+	copyEvents chan event.GenericEvent
+	recorder   *record.FakeRecorder
+	dstCreds   *RegistryCredentials
+}
+
+func newE2EHarness(t *testing.T, registryManager RegistryManager, dst *testRegistry, objs ...client.Object) *e2eHarness {
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := NewCopyQueue(registryManager, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = queue.Start(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return &e2eHarness{
+		client:     fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build(),
+		queue:      queue,
+		copyEvents: make(chan event.GenericEvent, 10),
+		recorder:   record.NewFakeRecorder(10),
+		dstCreds: &RegistryCredentials{
+			URL:      dst.Host,
+			Username: dst.username,
+			Password: dst.password,
+		},
+	}
+}
+
+func (h *e2eHarness) deploymentReconciler() *DeploymentImageBackupReconciler {
+	return &DeploymentImageBackupReconciler{
+		Client:                    h.client,
+		Scheme:                    scheme.Scheme,
+		CopyQueue:                 h.queue,
+		BackUpRegistryCredentials: NewBackupCredentials(h.dstCreds),
+		RetryPolicy:               RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		Recorder:                  h.recorder,
+		copyEvents:                h.copyEvents,
+	}
+}
+
+func (h *e2eHarness) daemonSetReconciler() *DaemonsetImageBackupReconciler {
+	return &DaemonsetImageBackupReconciler{
+		Client:                    h.client,
+		Scheme:                    scheme.Scheme,
+		CopyQueue:                 h.queue,
+		BackUpRegistryCredentials: NewBackupCredentials(h.dstCreds),
+		RetryPolicy:               RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		Recorder:                  h.recorder,
+		copyEvents:                h.copyEvents,
+	}
+}
+
+// reconcileUntilDone reconciles obj until it neither requeues nor waits for a
+// copy.
+func (h *e2eHarness) reconcileUntilDone(t *testing.T, r reconcile.Reconciler, obj client.Object) ctrl.Result {
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(obj)}
+	for i := 0; i < 10; i++ {
+		result, err := r.Reconcile(context.Background(), req)
+		require.NoError(t, err)
+		if result.Requeue || result.RequeueAfter > 0 {
+			continue
+		}
+		if !copiesPending(h.queue) {
+			return result
+		}
+		select {
+		case <-h.copyEvents:
+			// a copy finished, reconcile again to pick up the result
+		case <-time.After(time.Minute):
+			t.Fatal("copy did not finish")
+		}
+	}
+	t.Fatal("deployment was not reconciled")
+	return ctrl.Result{}
+}
+
+// copiesPending reports whether queue has a copy that didn't finish yet.
+func copiesPending(queue *CopyQueue) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for _, task := range queue.tasks {
+		if task.status.State == CopyPending {
+			return true
+		}
+	}
+	return false
+}
+
+func newE2EDeployment(image string, pullSecrets ...string) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+			},
+		},
+	}
+	for _, name := range pullSecrets {
+		deployment.Spec.Template.Spec.ImagePullSecrets = append(deployment.Spec.Template.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	}
+	return deployment
+}
+
+func newE2EPullSecret(name, host, username, password string) *corev1.Secret {
+	secret, _ := getDockerConfigSecret(username, password, host)
+	secret.Name = name
+	secret.Namespace = "default"
+	secret.Type = corev1.SecretTypeDockerConfigJson
+	return secret
+}
+
+func TestReconcileCopiesImage(t *testing.T) {
+	for backend, newRegistryManager := range registryManagerFactories {
+		t.Run(backend, func(t *testing.T) {
+			src := newTestRegistry(t, "user1", "password1")
+			dst := newTestRegistry(t, "backup", "backup-password")
+			manifest := src.PushImage(t, "library/app", "v1")
+
+			registryManager := newRegistryManager(testRegistryConfig(t, src, dst), t)
+			deployment := newE2EDeployment(src.Host+"/library/app:v1", "src-creds")
+			h := newE2EHarness(t, registryManager, dst, deployment, newE2EPullSecret("src-creds", src.Host, "user1", "password1"))
+
+			h.reconcileUntilDone(t, h.deploymentReconciler(), deployment)
+
+			// the manifest is copied unchanged, so the image keeps its digest
+			copied, ok := dst.Manifest("backup/app", "v1")
+			require.True(t, ok, "manifest was not copied")
+			assert.Equal(t, manifest, copied)
+
+			updated := &appsv1.Deployment{}
+			require.NoError(t, h.client.Get(context.Background(), client.ObjectKeyFromObject(deployment), updated))
+			assert.Equal(t, dst.Host+"/backup/app:v1", updated.Spec.Template.Spec.Containers[0].Image)
+			assert.Equal(t, []corev1.LocalObjectReference{{Name: "src-creds"}, {Name: "destination-registry-creds"}}, updated.Spec.Template.Spec.ImagePullSecrets)
+			assert.Equal(t, "destination-registry-creds", updated.Annotations[PULL_SECRET_ANNOTATION])
+		})
+	}
+}
+
+func TestReconcileCopiesPublicImage(t *testing.T) {
+	for backend, newRegistryManager := range registryManagerFactories {
+		t.Run(backend, func(t *testing.T) {
+			src := newTestRegistry(t, "", "")
+			dst := newTestRegistry(t, "backup", "backup-password")
+			src.PushImage(t, "app", "latest")
+
+			registryManager := newRegistryManager(testRegistryConfig(t, src, dst), t)
+			deployment := newE2EDeployment(src.Host + "/app")
+			h := newE2EHarness(t, registryManager, dst, deployment)
+
+			h.reconcileUntilDone(t, h.deploymentReconciler(), deployment)
+
+			_, ok := dst.Manifest("backup/app", "latest")
+			assert.True(t, ok, "manifest was not copied")
+		})
+	}
+}
+
+func TestReconcileRejectedCredentials(t *testing.T) {
+	for backend, newRegistryManager := range registryManagerFactories {
+		t.Run(backend, func(t *testing.T) {
+			src := newTestRegistry(t, "user1", "password1")
+			dst := newTestRegistry(t, "backup", "backup-password")
+			src.PushImage(t, "library/app", "v1")
+
+			registryManager := newRegistryManager(testRegistryConfig(t, src, dst), t)
+			deployment := newE2EDeployment(src.Host+"/library/app:v1", "src-creds")
+			pullSecret := newE2EPullSecret("src-creds", src.Host, "user1", "wrong")
+			h := newE2EHarness(t, registryManager, dst, deployment, pullSecret)
+
+			// the permanent failure is reported and not requeued
+			result := h.reconcileUntilDone(t, h.deploymentReconciler(), deployment)
+			assert.Equal(t, ctrl.Result{}, result)
+			require.Len(t, h.recorder.Events, 1)
+			assert.Contains(t, <-h.recorder.Events, EVENT_REASON_COPY_FAILED)
+
+			_, ok := dst.Manifest("backup/app", "v1")
+			assert.False(t, ok)
+			updated := &appsv1.Deployment{}
+			require.NoError(t, h.client.Get(context.Background(), client.ObjectKeyFromObject(deployment), updated))
+			assert.Equal(t, src.Host+"/library/app:v1", updated.Spec.Template.Spec.Containers[0].Image)
+			// the pull secret of the backup registry is only created for backed up images
+			err := h.client.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: DESTINATION_SECRET_NAME}, &corev1.Secret{})
+			assert.True(t, errors.IsNotFound(err))
+		})
+	}
+}
+
+func TestReconcileDaemonSetCopiesImage(t *testing.T) {
+	for backend, newRegistryManager := range registryManagerFactories {
+		t.Run(backend, func(t *testing.T) {
+			src := newTestRegistry(t, "user1", "password1")
+			dst := newTestRegistry(t, "backup", "backup-password")
+			manifest := src.PushImage(t, "agent", "1.0")
+
+			registryManager := newRegistryManager(testRegistryConfig(t, src, dst), t)
+			daemonSet := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default"},
+				Spec: appsv1.DaemonSetSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers:       []corev1.Container{{Name: "agent", Image: src.Host + "/agent:1.0"}},
+							ImagePullSecrets: []corev1.LocalObjectReference{{Name: "src-creds"}},
+						},
+					},
+				},
+			}
+			h := newE2EHarness(t, registryManager, dst, daemonSet, newE2EPullSecret("src-creds", src.Host, "user1", "password1"))
+
+			h.reconcileUntilDone(t, h.daemonSetReconciler(), daemonSet)
+
+			copied, ok := dst.Manifest("backup/agent", "1.0")
+			require.True(t, ok, "manifest was not copied")
+			assert.Equal(t, manifest, copied)
+
+			updated := &appsv1.DaemonSet{}
+			require.NoError(t, h.client.Get(context.Background(), client.ObjectKeyFromObject(daemonSet), updated))
+			assert.Equal(t, dst.Host+"/backup/agent:1.0", updated.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
+
+func TestReconcileScanRejectsImage(t *testing.T) {
+	src := newTestRegistry(t, "", "")
+	dst := newTestRegistry(t, "backup", "backup-password")
+	src.PushImage(t, "app", "v1")
+	src.PushImage(t, "sidecar", "v1")
+
+	registryManager := registryManagerFactories[REGISTRY_BACKEND_DISTRIBUTION](testRegistryConfig(t, src, dst), t)
+	deployment := newE2EDeployment(src.Host + "/app:v1")
+	deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, corev1.Container{Name: "sidecar", Image: src.Host + "/sidecar:v1"})
+	h := newE2EHarness(t, registryManager, dst, deployment)
+	scanner := newTestScanner(t, map[string]ScanResult{
+		dst.Host + "/backup/app:v1": {Verdict: SCAN_VERDICT_FAIL, Reason: "critical vulnerabilities"},
+	})
+	h.queue.Scanner = &ImageScanner{URL: scanner.URL}
+	r := h.deploymentReconciler()
+	r.ReportStatus = true
+
+	h.reconcileUntilDone(t, r, deployment)
+
+	// the rejected image keeps its source, the other one is rewritten
+	updated := &appsv1.Deployment{}
+	require.NoError(t, h.client.Get(context.Background(), client.ObjectKeyFromObject(deployment), updated))
+	assert.Equal(t, src.Host+"/app:v1", updated.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, dst.Host+"/backup/sidecar:v1", updated.Spec.Template.Spec.Containers[1].Image)
+	assert.Contains(t, updated.Annotations[STATUS_ANNOTATION], `"scan":{"verdict":"fail","reason":"critical vulnerabilities"}`)
+}
+
+func TestReconcileRegistryToken(t *testing.T) {
+	for backend, newRegistryManager := range registryManagerFactories {
+		t.Run(backend, func(t *testing.T) {
+			src := newTestTokenRegistry(t, "registry-token")
+			dst := newTestRegistry(t, "backup", "backup-password")
+			src.PushImage(t, "app", "v1")
+
+			registryManager := newRegistryManager(testRegistryConfig(t, src, dst), t)
+			deployment := newE2EDeployment(src.Host+"/app:v1", "src-token")
+			pullSecret := newE2EPullSecret("src-token", src.Host, "", "")
+			pullSecret.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"` + src.Host + `":{"registrytoken":"registry-token"}}}`)
+			h := newE2EHarness(t, registryManager, dst, deployment, pullSecret)
+
+			h.reconcileUntilDone(t, h.deploymentReconciler(), deployment)
+
+			_, ok := dst.Manifest("backup/app", "v1")
+			assert.True(t, ok, "manifest was not copied")
+		})
+	}
+}
@@ -1,86 +1,255 @@
+//go:build !exclude_containers_image
+// +build !exclude_containers_image
+
 package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"strings"
 	"time"
 
-	//"time"
-
-	"github.com/containers/common/pkg/retry"
 	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/signature"
 
 	//"github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-type RegistryManager interface {
-	CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstCredentials *RegistryCredentials) error
-}
-
 type ContainerRegistryManager struct {
+	RegistryConfig *RegistryConfig
+	RetryPolicy    RetryPolicy
+	RateLimiter    *RegistryRateLimiter
+	// ProgressInterval is how often the progress of a running copy is logged.
+	ProgressInterval time.Duration
+	// BlobInfoCacheDir keeps the blob info cache shared by all copies, so blobs
+	// already known to exist at the destination are not copied again.
+	BlobInfoCacheDir string
+	// TemporaryDir holds large temporary files, e.g. layers being recompressed.
+	TemporaryDir string
+	// RegistriesConfPath is a registries.conf file whose mirrors are tried
+	// before the source registry itself.
+	RegistriesConfPath string
+	// CredentialHelpers obtains credentials of registries with a credential
+	// helper at copy time.
+	CredentialHelpers *CredentialHelpers
 }
 
-type RegistryCredentials struct {
-	URL      string
-	Username string
-	Password string
+func (c *ContainerRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstCredentials *RegistryCredentials) error {
+	dstHost := registryHost(dstImage)
+
+	destRef, err := alltransports.ParseImageName("docker://" + dstImage)
+	if err != nil {
+		return permanentErrorf("invalid destination name %s: %v", dstImage, err)
+	}
+
+	return c.copyImage(ctx, srcImage, srcRegistryCredentials, copyDestination{
+		ref:         destRef,
+		host:        dstHost,
+		image:       dstImage,
+		credentials: dstCredentials,
+		sys:         c.systemContext(dstHost),
+	})
 }
 
-func (c *ContainerRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage string, srcRegistryCredentials, dstCredentials *RegistryCredentials) error {
+// copyDestination is where copyImage writes an image to.
+type copyDestination struct {
+	ref types.ImageReference
+	// host is the destination registry, it is rate limited like the source.
+	// Empty for destinations that are not a registry.
+	host        string
+	image       string
+	credentials *RegistryCredentials
+	sys         *types.SystemContext
+	// prepare, if set, runs before every copy attempt.
+	prepare func() error
+}
 
-	srcImage = "docker://" + srcImage
-	dstImage = "docker://" + dstImage
+// copyImage copies srcImage to dest, retrying transient failures.
+func (c *ContainerRegistryManager) copyImage(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials, dest copyDestination) error {
 
-	srcRef, err := alltransports.ParseImageName(srcImage)
-	if err != nil {
-		return fmt.Errorf("invalid source name %s: %v", srcImage, err)
+	lg := log.FromContext(ctx).WithValues("srcImage", srcImage, "dstImage", transports.ImageName(dest.ref))
+	progress := copyProgressFromContext(ctx)
+	progressInterval := c.ProgressInterval
+	if progressInterval <= 0 {
+		progressInterval = DEFAULT_COPY_PROGRESS_INTERVAL
 	}
-	destRef, err := alltransports.ParseImageName(dstImage)
+
+	srcHost := registryHost(srcImage)
+
+	srcRef, err := alltransports.ParseImageName("docker://" + srcImage)
 	if err != nil {
-		return fmt.Errorf("invalid destination name %s: %v", dstImage, err)
+		return permanentErrorf("invalid source name docker://%s: %v", srcImage, err)
 	}
 
 	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
-	if err != nil {
-		return fmt.Errorf("failed to get default policy: %v", err)
-	}
 	policyCtx, err := signature.NewPolicyContext(policy)
 	if err != nil {
 		return fmt.Errorf("failed to get default policy: %v", err)
 	}
+	defer policyCtx.Destroy()
 
-	srcCtx := &types.SystemContext{
-		OSChoice:      "linux",
-		VariantChoice: "amd64",
-	}
-	if srcRegistryCredentials != nil {
-		srcCtx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: srcRegistryCredentials.Username,
-			Password: srcRegistryCredentials.Password,
+	return c.RetryPolicy.retry(ctx, func() error {
+		if err := c.RateLimiter.waitForCopy(ctx, srcHost, dest.host); err != nil {
+			return err
 		}
-	}
 
-	dstCtx := &types.SystemContext{
-		DockerAuthConfig: &types.DockerAuthConfig{
-			Username: dstCredentials.Username,
-			Password: dstCredentials.Password,
-		},
-	}
+		// credentials of credential helpers may have expired since the last attempt
+		srcCredentials, err := c.CredentialHelpers.resolve(ctx, srcHost, srcImage, srcRegistryCredentials)
+		if err != nil {
+			return err
+		}
+		srcCtx := c.sourceContext(srcHost, srcCredentials)
+		if dest.host != "" {
+			dstCredentials, err := c.CredentialHelpers.resolve(ctx, dest.host, dest.image, dest.credentials)
+			if err != nil {
+				return err
+			}
+			setDockerAuth(dest.sys, dstCredentials)
+		}
+		if dest.prepare != nil {
+			if err := dest.prepare(); err != nil {
+				return err
+			}
+		}
 
-	return retry.RetryIfNecessary(ctx, func() error {
-		_, err = copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
-			SourceCtx:      srcCtx,
-			DestinationCtx: dstCtx,
-			ReportWriter:   os.Stdout,
+		progress.reset()
+		progressEvents := make(chan types.ProgressProperties)
+		progressDone := make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			reportCopyProgress(lg, translateCopyProgress(progressEvents), progress, srcHost, progressInterval)
+		}()
+
+		_, err = copy.Image(ctx, policyCtx, dest.ref, srcRef, &copy.Options{
+			SourceCtx:        srcCtx,
+			DestinationCtx:   dest.sys,
+			ProgressInterval: copyProgressEventInterval,
+			Progress:         progressEvents,
 		})
+		close(progressEvents)
+		<-progressDone
+
+		if errors.Is(err, docker.ErrTooManyRequests) && c.RateLimiter != nil {
+			c.RateLimiter.Pause(srcHost, DEFAULT_THROTTLE_PAUSE)
+			if dest.host != "" {
+				c.RateLimiter.Pause(dest.host, DEFAULT_THROTTLE_PAUSE)
+			}
+		}
+		if err != nil && isUnauthorizedError(err) && c.CredentialHelpers.invalidate(srcHost, dest.host) {
+			return &expiredCredentialsError{err: err}
+		}
 		if err != nil {
 			return err
 		}
 
 		return nil
-	}, &retry.RetryOptions{MaxRetry: 1, Delay: time.Second * 5})
+	})
+}
+
+func (c *ContainerRegistryManager) ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error) {
+	srcRef, err := alltransports.ParseImageName("docker://" + srcImage)
+	if err != nil {
+		return 0, permanentErrorf("invalid source name %s: %v", srcImage, err)
+	}
+
+	srcHost := registryHost(srcImage)
+	// inspecting the manifest counts against the quota of the source registry
+	if err := c.RateLimiter.waitForCopy(ctx, srcHost, ""); err != nil {
+		return 0, err
+	}
+	srcCredentials, err := c.CredentialHelpers.resolve(ctx, srcHost, srcImage, srcRegistryCredentials)
+	if err != nil {
+		return 0, err
+	}
+
+	img, err := srcRef.NewImage(ctx, c.sourceContext(srcHost, srcCredentials))
+	if err != nil {
+		if errors.Is(err, docker.ErrTooManyRequests) && c.RateLimiter != nil {
+			c.RateLimiter.Pause(srcHost, DEFAULT_THROTTLE_PAUSE)
+		}
+		return 0, classifyCopyError(fmt.Errorf("failed to inspect image %s: %w", srcImage, err))
+	}
+	defer img.Close()
+
+	var size int64
+	for _, layer := range append(img.LayerInfos(), img.ConfigInfo()) {
+		if layer.Size > 0 {
+			size += layer.Size
+		}
+	}
+	return size, nil
+}
+
+// translateCopyProgress translates the progress events of containers/image
+// until events is closed.
+func translateCopyProgress(events <-chan types.ProgressProperties) <-chan copyProgressEvent {
+	translated := make(chan copyProgressEvent)
+	go func() {
+		defer close(translated)
+		for e := range events {
+			switch e.Event {
+			case types.ProgressEventNewArtifact:
+				translated <- copyProgressEvent{kind: copyProgressBlobStarted, size: e.Artifact.Size}
+			case types.ProgressEventRead, types.ProgressEventDone:
+				translated <- copyProgressEvent{kind: copyProgressBlobRead, bytesRead: e.OffsetUpdate}
+			case types.ProgressEventSkipped:
+				translated <- copyProgressEvent{kind: copyProgressBlobSkipped, size: e.Artifact.Size}
+			}
+		}
+	}()
+	return translated
+}
+
+// sourceContext returns the settings to pull from the registry at host. The
+// linux/amd64 image is chosen from manifest lists.
+func (c *ContainerRegistryManager) sourceContext(host string, credentials *RegistryCredentials) *types.SystemContext {
+	sys := c.systemContext(host)
+	sys.OSChoice = "linux"
+	sys.VariantChoice = "amd64"
+	sys.SystemRegistriesConfPath = c.RegistriesConfPath
+	setDockerAuth(sys, credentials)
+	return sys
+}
+
+// setDockerAuth sets the credentials sys authenticates to a registry with.
+func setDockerAuth(sys *types.SystemContext, credentials *RegistryCredentials) {
+	sys.DockerAuthConfig = nil
+	sys.DockerBearerRegistryToken = ""
+	if credentials == nil {
+		return
+	}
+	sys.DockerAuthConfig = &types.DockerAuthConfig{
+		Username:      credentials.Username,
+		Password:      credentials.Password,
+		IdentityToken: credentials.IdentityToken,
+	}
+	sys.DockerBearerRegistryToken = credentials.RegistryToken
+}
+
+// CheckCredentials logs into the registry of credentials.
+func (c *ContainerRegistryManager) CheckCredentials(ctx context.Context, credentials *RegistryCredentials) error {
+	host := normalizeRegistryHost(strings.Split(credentials.URL, "/")[0])
+	return docker.CheckAuth(ctx, c.systemContext(host), credentials.Username, credentials.Password, host)
+}
+
+// systemContext returns the settings to connect to the registry at host.
+func (c *ContainerRegistryManager) systemContext(host string) *types.SystemContext {
+	sys := &types.SystemContext{
+		BlobInfoCacheDir:     c.BlobInfoCacheDir,
+		BigFilesTemporaryDir: c.TemporaryDir,
+	}
+
+	if tlsConfig := c.RegistryConfig.hostConfig(host).TLS; tlsConfig != nil {
+		sys.DockerCertPath = tlsConfig.CertDir
+		if tlsConfig.Insecure {
+			sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+		}
+	}
+	return sys
 }
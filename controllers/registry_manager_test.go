@@ -0,0 +1,99 @@
+//go:build !exclude_containers_image
+// +build !exclude_containers_image
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	registryManagerFactories[REGISTRY_BACKEND_CONTAINERS_IMAGE] = func(config *RegistryConfig, t *testing.T) RegistryManager {
+		return &ContainerRegistryManager{
+			RegistryConfig:   config,
+			RetryPolicy:      RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			BlobInfoCacheDir: t.TempDir(),
+			TemporaryDir:     t.TempDir(),
+		}
+	}
+}
+
+func TestClassifyContainersImageError(t *testing.T) {
+
+	assert.True(t, IsPermanentError(classifyCopyError(docker.ErrUnauthorizedForCredentials{Err: errors.New("denied")})))
+	assert.False(t, IsPermanentError(classifyCopyError(docker.ErrTooManyRequests)))
+
+	attempts := 0
+	policy := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	err := policy.retry(context.Background(), func() error {
+		attempts++
+		return docker.ErrUnauthorizedForCredentials{Err: errors.New("denied")}
+	})
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, 1, attempts)
+}
+
+func TestContainerRegistryManagerSystemContext(t *testing.T) {
+
+	certDir := t.TempDir()
+	registryManager := &ContainerRegistryManager{RegistryConfig: &RegistryConfig{Registries: map[string]RegistryHostConfig{
+		"registry.internal:5000": {TLS: &TLSConfig{CertDir: certDir}},
+		"lab.local":              {TLS: &TLSConfig{Insecure: true}},
+	}}}
+	assert.Equal(t, certDir, registryManager.systemContext("registry.internal:5000").DockerCertPath)
+	assert.Equal(t, types.OptionalBoolTrue, registryManager.systemContext("lab.local").DockerInsecureSkipTLSVerify)
+	assert.Equal(t, types.OptionalBoolUndefined, registryManager.systemContext("quay.io").DockerInsecureSkipTLSVerify)
+}
+
+func TestTranslateCopyProgress(t *testing.T) {
+
+	events := make(chan types.ProgressProperties, 4)
+	layer := types.BlobInfo{Size: 300}
+	events <- types.ProgressProperties{Event: types.ProgressEventNewArtifact, Artifact: layer}
+	events <- types.ProgressProperties{Event: types.ProgressEventRead, Artifact: layer, Offset: 100, OffsetUpdate: 100}
+	events <- types.ProgressProperties{Event: types.ProgressEventDone, Artifact: layer, Offset: 300, OffsetUpdate: 200}
+	events <- types.ProgressProperties{Event: types.ProgressEventSkipped, Artifact: types.BlobInfo{Size: 50}}
+	close(events)
+
+	var translated []copyProgressEvent
+	for e := range translateCopyProgress(events) {
+		translated = append(translated, e)
+	}
+	assert.Equal(t, []copyProgressEvent{
+		{kind: copyProgressBlobStarted, size: 300},
+		{kind: copyProgressBlobRead, bytesRead: 100},
+		{kind: copyProgressBlobRead, bytesRead: 200},
+		{kind: copyProgressBlobSkipped, size: 50},
+	}, translated)
+}
+
+func TestContainerRegistryManagerCheckCredentials(t *testing.T) {
+
+	registry := newTestRegistry(t, "backup", "password")
+	registryManager := &ContainerRegistryManager{RegistryConfig: testRegistryConfig(t, registry)}
+
+	ctx := context.Background()
+	assert.NoError(t, registryManager.CheckCredentials(ctx, &RegistryCredentials{URL: registry.Host, Username: "backup", Password: "password"}))
+	assert.Error(t, registryManager.CheckCredentials(ctx, &RegistryCredentials{URL: registry.Host, Username: "backup", Password: "wrong-password"}))
+}
+
+func TestContainerRegistryManagerImageSizeRateLimit(t *testing.T) {
+
+	registry := newTestRegistry(t, "", "")
+	registry.PushImage(t, "app", "v1")
+	c := registryManagerFactories[REGISTRY_BACKEND_CONTAINERS_IMAGE](testRegistryConfig(t, registry), t).(*ContainerRegistryManager)
+	c.RateLimiter = NewRegistryRateLimiter(c.RegistryConfig)
+	c.RateLimiter.Pause(registry.Host, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err := c.ImageSize(ctx, registry.Host+"/app:v1", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	errcodev2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/docker/distribution/registry/client"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	DEFAULT_COPY_MAX_RETRIES      = 3
+	DEFAULT_COPY_INITIAL_BACKOFF  = time.Second * 5
+	DEFAULT_COPY_MAX_BACKOFF      = time.Minute * 5
+	DEFAULT_COPY_BACKOFF_MULTIPLE = 2
+)
+
+// RetryPolicy controls how often a failed image copy is retried and how long
+// to wait between attempts. The same backoff bounds are used when a workload
+// is requeued after a transient failure.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     DEFAULT_COPY_MAX_RETRIES,
+		InitialBackoff: DEFAULT_COPY_INITIAL_BACKOFF,
+		MaxBackoff:     DEFAULT_COPY_MAX_BACKOFF,
+	}
+}
+
+// backoff returns the delay before the given retry attempt (starting at 0).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= DEFAULT_COPY_BACKOFF_MULTIPLE
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// rateLimiter returns a workqueue rate limiter that requeues failed
+// reconciles with the policy's exponential backoff.
+func (p RetryPolicy) rateLimiter() workqueue.RateLimiter {
+	if p.InitialBackoff <= 0 || p.MaxBackoff <= 0 {
+		p = DefaultRetryPolicy()
+	}
+	return workqueue.NewItemExponentialFailureRateLimiter(p.InitialBackoff, p.MaxBackoff)
+}
+
+// retry runs operation until it succeeds, fails with a permanent error, the
+// retries are exhausted or the context is done. The returned error is
+// classified, see IsPermanentError.
+func (p RetryPolicy) retry(ctx context.Context, operation func() error) error {
+	err := classifyCopyError(operation())
+	for attempt := 0; err != nil && !IsPermanentError(err) && attempt < p.MaxRetries; attempt++ {
+		select {
+		case <-time.After(p.backoff(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+		err = classifyCopyError(operation())
+	}
+	return err
+}
+
+// PermanentError wraps a copy error that will not go away by retrying, such
+// as denied access, an unknown manifest or an invalid image reference.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func IsPermanentError(err error) bool {
+	var permanentErr *PermanentError
+	return errors.As(err, &permanentErr)
+}
+
+func permanentErrorf(format string, a ...interface{}) error {
+	return &PermanentError{Err: fmt.Errorf(format, a...)}
+}
+
+// classifyCopyError wraps err in a PermanentError if retrying the copy cannot
+// succeed. Everything else, including errors we don't recognize, is treated as
+// transient.
+func classifyCopyError(err error) error {
+	if err == nil || IsPermanentError(err) || isTransientCopyError(err) {
+		return err
+	}
+	if isPermanentCopyError(err) {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// registryErrorCode returns the code of a registry API error. Errors whose
+// message is the default one of their code are decoded to a bare ErrorCode.
+func registryErrorCode(err error) (errcode.ErrorCode, bool) {
+	var codeErr errcode.Error
+	if errors.As(err, &codeErr) {
+		return codeErr.Code, true
+	}
+	var code errcode.ErrorCode
+	if errors.As(err, &code) {
+		return code, true
+	}
+	return 0, false
+}
+
+// statusCodeRegexp matches the status codes containers/image embeds in the
+// message of errors it has flattened to plain strings.
+var statusCodeRegexp = regexp.MustCompile(`(?:StatusCode: |invalid status code from registry )(\d{3})`)
+
+func httpStatusCode(err error) int {
+	var responseErr *client.UnexpectedHTTPResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode
+	}
+	if m := statusCodeRegexp.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code
+	}
+	return 0
+}
+
+func isTransientCopyError(err error) bool {
+	var expiredErr *expiredCredentialsError
+	if errors.As(err, &expiredErr) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || isDockerTooManyRequestsError(err) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	code := httpStatusCode(err)
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+func isPermanentCopyError(err error) bool {
+	if isDockerUnauthorizedError(err) {
+		return true
+	}
+
+	var errs errcode.Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			if !isPermanentCopyError(e) {
+				return false
+			}
+		}
+		return len(errs) > 0
+	}
+
+	if code, ok := registryErrorCode(err); ok {
+		switch code {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied,
+			errcodev2.ErrorCodeNameUnknown, errcodev2.ErrorCodeNameInvalid,
+			errcodev2.ErrorCodeManifestUnknown, errcodev2.ErrorCodeTagInvalid:
+			return true
+		}
+		return false
+	}
+
+	switch httpStatusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	errcodev2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyCopyError(t *testing.T) {
+
+	permanent := []error{
+		fmt.Errorf("reading manifest: %w", errcode.Errors{errcodev2.ErrorCodeManifestUnknown.WithMessage("manifest unknown")}),
+		errcode.ErrorCodeDenied.WithMessage("requested access to the resource is denied"),
+		fmt.Errorf("reading manifest: %w", errcode.Errors{errcode.ErrorCodeUnauthorized}),
+		errors.New("reading manifest latest in quay.io/foo: StatusCode: 404, not found"),
+	}
+	for _, err := range permanent {
+		assert.True(t, IsPermanentError(classifyCopyError(err)), "expected %v to be permanent", err)
+	}
+
+	transient := []error{
+		context.DeadlineExceeded,
+		errors.New("invalid status code from registry 503 (Service Unavailable)"),
+		errors.New("connection reset by peer"),
+	}
+	for _, err := range transient {
+		assert.False(t, IsPermanentError(classifyCopyError(err)), "expected %v to be transient", err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+
+	policy := RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 3}
+	assert.Equal(t, time.Millisecond, policy.backoff(0))
+	assert.Equal(t, time.Millisecond*2, policy.backoff(1))
+	assert.Equal(t, time.Millisecond*3, policy.backoff(5))
+
+	attempts := 0
+	err := policy.retry(context.Background(), func() error {
+		attempts++
+		return errcode.ErrorCodeTooManyRequests.WithMessage("slow down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = policy.retry(context.Background(), func() error {
+		attempts++
+		return errcode.ErrorCodeUnauthorized.WithMessage("denied")
+	})
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, 1, attempts)
+}
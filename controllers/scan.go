@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	DEFAULT_SCAN_TIMEOUT = time.Minute
+)
+
+// ScanVerdict is the outcome of scanning a backup image.
+type ScanVerdict string
+
+const (
+	SCAN_VERDICT_PASS ScanVerdict = "pass"
+	SCAN_VERDICT_FAIL ScanVerdict = "fail"
+	// SCAN_VERDICT_ERROR is recorded if the scanner could not be reached and
+	// the scanner fails open.
+	SCAN_VERDICT_ERROR ScanVerdict = "error"
+)
+
+type ScanResult struct {
+	Verdict ScanVerdict `json:"verdict"`
+	Reason  string      `json:"reason,omitempty"`
+}
+
+// scanRequest is posted to the scanning endpoint for every backup image.
+type scanRequest struct {
+	Image       string `json:"image"`
+	SourceImage string `json:"sourceImage"`
+}
+
+// ImageScanner asks an HTTP scanning endpoint for a verdict on backup images
+// before workloads are rewritten to them.
+type ImageScanner struct {
+	URL string
+	// FailOpen rewrites workloads if the scanner can't be reached. Otherwise
+	// the rewrite waits until the scanner returns a verdict.
+	FailOpen bool
+	Timeout  time.Duration
+	Client   *http.Client
+}
+
+// Scan returns the verdict of the scanner on image, which was copied from
+// srcImage.
+func (s *ImageScanner) Scan(ctx context.Context, image, srcImage string) (ScanResult, error) {
+	body, err := json.Marshal(scanRequest{Image: image, SourceImage: srcImage})
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_SCAN_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return ScanResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := s.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to scan %s: %w", image, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to scan %s: %w", image, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ScanResult{}, fmt.Errorf("failed to scan %s: scanner returned %s", image, resp.Status)
+	}
+	result := ScanResult{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return ScanResult{}, fmt.Errorf("failed to scan %s: invalid response: %v", image, err)
+	}
+	if result.Verdict != SCAN_VERDICT_PASS && result.Verdict != SCAN_VERDICT_FAIL {
+		return ScanResult{}, fmt.Errorf("failed to scan %s: unknown verdict %q", image, result.Verdict)
+	}
+	return result, nil
+}
+
+// scanCopy scans the backup image of job. If the scanner fails and fails open
+// the error is recorded as SCAN_VERDICT_ERROR.
+func (s *ImageScanner) scanCopy(ctx context.Context, job CopyJob) (*ScanResult, error) {
+	result, err := s.Scan(ctx, job.DstImage, job.SrcImage)
+	if err != nil {
+		if !s.FailOpen {
+			return nil, err
+		}
+		result = ScanResult{Verdict: SCAN_VERDICT_ERROR, Reason: err.Error()}
+	}
+	return &result, nil
+}
+
+// copyScanResults returns the verdicts the CopyQueue recorded for the copies of
+// jobs to the primary registry by source image, and the first scan error.
+func copyScanResults(jobs []CopyJob, statuses []CopyStatus) (map[string]ScanResult, error) {
+	results := make(map[string]ScanResult)
+	var scanErr error
+	for i, job := range jobs {
+		if job.Destination != "" {
+			continue
+		}
+		if statuses[i].ScanErr != nil && scanErr == nil {
+			scanErr = statuses[i].ScanErr
+		}
+		if statuses[i].Scan != nil {
+			results[job.SrcImage] = *statuses[i].Scan
+		}
+	}
+	return results, scanErr
+}
+
+// failedScans returns the source images whose backup failed the scan.
+func failedScans(results map[string]ScanResult) map[string]string {
+	rejected := make(map[string]string)
+	for image, result := range results {
+		if result.Verdict == SCAN_VERDICT_FAIL {
+			rejected[image] = result.Reason
+		}
+	}
+	return rejected
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// newTestScanner starts a scanning endpoint that fails images listed in
+// verdicts and passes everything else.
+func newTestScanner(t *testing.T, verdicts map[string]ScanResult) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		request := scanRequest{}
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result, ok := verdicts[request.Image]
+		if !ok {
+			result = ScanResult{Verdict: SCAN_VERDICT_PASS}
+		}
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// runScannedCopies copies jobs through a CopyQueue with scanner and returns
+// their statuses once all of them finished.
+func runScannedCopies(t *testing.T, scanner *ImageScanner, jobs []CopyJob) []CopyStatus {
+	queue := NewCopyQueue(&countingRegistryManager{copies: map[string]int{}}, 1)
+	queue.Scanner = scanner
+	events := make(chan event.GenericEvent, len(jobs))
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	for _, job := range jobs {
+		queue.Enqueue(job, events, deployment)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	for range jobs {
+		select {
+		case <-events:
+		case <-time.After(time.Second * 5):
+			t.Fatal("copy did not finish")
+		}
+	}
+
+	statuses := make([]CopyStatus, len(jobs))
+	for i, job := range jobs {
+		statuses[i] = queue.Enqueue(job, events, deployment)
+	}
+	return statuses
+}
+
+func TestCopyQueueScansBackupImages(t *testing.T) {
+	var scans int32
+	verdicts := newTestScanner(t, map[string]ScanResult{
+		"backup.io/user/bad:1": {Verdict: SCAN_VERDICT_FAIL, Reason: "CVE-2021-44228"},
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&scans, 1)
+		verdicts.Config.Handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	jobs := []CopyJob{
+		{SrcImage: "docker.io/good:1", DstImage: "backup.io/user/good:1"},
+		{SrcImage: "docker.io/bad:1", DstImage: "backup.io/user/bad:1"},
+		{SrcImage: "docker.io/bad:1", DstImage: "replica.io/user/bad:1", Destination: "replica"},
+	}
+
+	statuses := runScannedCopies(t, &ImageScanner{URL: server.URL}, jobs)
+	// replicas aren't scanned, and the verdicts are kept with the copy results
+	assert.EqualValues(t, 2, atomic.LoadInt32(&scans))
+	results, err := copyScanResults(jobs, statuses)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]ScanResult{
+		"docker.io/good:1": {Verdict: SCAN_VERDICT_PASS},
+		"docker.io/bad:1":  {Verdict: SCAN_VERDICT_FAIL, Reason: "CVE-2021-44228"},
+	}, results)
+	assert.Equal(t, map[string]string{"docker.io/bad:1": "CVE-2021-44228"}, failedScans(results))
+
+	status := newBackupStatus(jobs, statuses).setScanResults(results)
+	assert.Equal(t, &ScanResult{Verdict: SCAN_VERDICT_FAIL, Reason: "CVE-2021-44228"}, status.Images[1].Scan)
+	assert.Nil(t, status.Images[2].Scan)
+
+	results, err = copyScanResults(jobs, runScannedCopies(t, nil, jobs))
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestCopyQueueScannerDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	jobs := []CopyJob{{SrcImage: "docker.io/app:1", DstImage: "backup.io/user/app:1"}}
+
+	// fail closed
+	statuses := runScannedCopies(t, &ImageScanner{URL: server.URL}, jobs)
+	assert.True(t, copiesFinished(statuses))
+	_, err := copyScanResults(jobs, statuses)
+	assert.Error(t, err)
+
+	// fail open
+	results, err := copyScanResults(jobs, runScannedCopies(t, &ImageScanner{URL: server.URL, FailOpen: true}, jobs))
+	require.NoError(t, err)
+	assert.Equal(t, SCAN_VERDICT_ERROR, results["docker.io/app:1"].Verdict)
+	assert.Empty(t, failedScans(results))
+}
+
+func TestQueueImageCopiesRescansFailedScans(t *testing.T) {
+	var scans int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the scanner is down for the first scan
+		if atomic.AddInt32(&scans, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(ScanResult{Verdict: SCAN_VERDICT_PASS})
+	}))
+	defer server.Close()
+	registryManager := &countingRegistryManager{copies: map[string]int{}}
+	queue := NewCopyQueue(registryManager, 1)
+	queue.Scanner = &ImageScanner{URL: server.URL}
+	events := make(chan event.GenericEvent, 1)
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "d1", Namespace: "ns"}}
+	jobs := []CopyJob{{SrcImage: "docker.io/app:1", DstImage: "backup.io/user/app:1"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Start(ctx)
+	queueImageCopies(queue, events, deployment, jobs)
+	<-events
+
+	statuses := queueImageCopies(queue, events, deployment, jobs)
+	assert.Error(t, statuses[0].ScanErr)
+
+	// the next reconcile scans again without copying again
+	statuses = queueImageCopies(queue, events, deployment, jobs)
+	assert.Equal(t, CopyPending, statuses[0].State)
+	<-events
+	statuses = queueImageCopies(queue, events, deployment, jobs)
+	results, err := copyScanResults(jobs, statuses)
+	require.NoError(t, err)
+	assert.Equal(t, SCAN_VERDICT_PASS, results["docker.io/app:1"].Verdict)
+	assert.Equal(t, 1, registryManager.copies["docker.io/app:1"])
+}
+
+func TestScanUnknownVerdict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{"verdict":"maybe"}`))
+	}))
+	defer server.Close()
+
+	_, err := (&ImageScanner{URL: server.URL}).Scan(context.Background(), "backup.io/user/app:1", "docker.io/app:1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// DestinationSecretReconciler keeps the pull secrets of the backup registry in
+// the namespaces of the workloads in sync with the current credentials, and
+// deletes them once no workload uses them. It reconciles them when they, their
+// pull credentials or the workloads of their namespace change, and all of them
+// on start and when the credentials are reloaded. Only secrets labeled
+// with MANAGED_LABEL are touched. Deleted secrets are created again by the
+// next reconcile of their workloads.
+type DestinationSecretReconciler struct {
+	client.Client
+	Credentials *BackupCredentials
+	// PullCredentials, if set, are distributed instead of Credentials.
+	PullCredentials *PullCredentials
+
+	resync chan event.GenericEvent
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;update;delete
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;watch
+
+func (r *DestinationSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	lg := log.FromContext(ctx)
+
+	secret := &corev1.Secret{}
+	err := r.Client.Get(ctx, req.NamespacedName, secret)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !isManagedSecret(secret) {
+		return ctrl.Result{}, nil
+	}
+
+	inUse, err := r.isInUse(ctx, secret)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !inUse {
+		if age := time.Since(secret.CreationTimestamp.Time); age < PULL_SECRET_GC_GRACE_PERIOD {
+			return ctrl.Result{RequeueAfter: PULL_SECRET_GC_GRACE_PERIOD - age}, nil
+		}
+		lg.Info("deleting unreferenced registry secret")
+		if err := r.Client.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	desired, err := getDestinationSecret(ctx, r.Client, r.PullCredentials, r.Credentials.Get(), req.Namespace)
+	if err != nil {
+		lg.Error(err, "failed to get docker config secret")
+		if IsPermanentError(err) {
+			// wait for the pull credentials to change
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if err := updateRegistrySecret(ctx, r.Client, secret, desired); err != nil {
+		lg.Error(err, "failed to update registry secret")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// resyncOnChange enqueues every pull secret of the backup registry when it
+// starts and whenever the credentials are reloaded.
+func (r *DestinationSecretReconciler) resyncOnChange(ctx context.Context) error {
+	for {
+		// taken before listing, so a reload during the resync isn't missed
+		changed := r.Credentials.Changed()
+
+		secrets, err := r.listDestinationSecrets(ctx)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "failed to list registry secrets")
+		}
+		for i := range secrets {
+			select {
+			case r.resync <- event.GenericEvent{Object: &secrets[i]}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+// isInUse reports whether a workload in the namespace of the pull secret
+// needs it. With ServiceAccounts the pods get it from their ServiceAccount,
+// so it is needed while workloads run images of the backup registry.
+func (r *DestinationSecretReconciler) isInUse(ctx context.Context, secret *corev1.Secret) (bool, error) {
+	if r.PullCredentials.serviceAccounts() {
+		if secret.Name != r.PullCredentials.secretName() {
+			return false, nil
+		}
+		return isRegistryUsed(ctx, r.Client, secret.Namespace, r.Credentials.Get().URL)
+	}
+	return isPullSecretReferenced(ctx, r.Client, secret.Namespace, secret.Name)
+}
+
+func (r *DestinationSecretReconciler) listDestinationSecrets(ctx context.Context) ([]corev1.Secret, error) {
+	secrets := &corev1.SecretList{}
+	if err := r.Client.List(ctx, secrets, client.MatchingLabels{MANAGED_LABEL: "true"}); err != nil {
+		return nil, err
+	}
+	return secrets.Items, nil
+}
+
+// pullCredentialsChanged maps a Secret with pull credentials to the pull
+// secrets built from it.
+func (r *DestinationSecretReconciler) pullCredentialsChanged(obj client.Object) []reconcile.Request {
+	if r.PullCredentials.isGlobal(obj) {
+		ctx := context.Background()
+		secrets, err := r.listDestinationSecrets(ctx)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "failed to list registry secrets")
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(secrets))
+		for _, secret := range secrets {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&secret)})
+		}
+		return requests
+	}
+	if obj.GetName() == PULL_CREDENTIALS_SECRET_NAME {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: r.PullCredentials.secretName()}}}
+	}
+	return nil
+}
+
+// workloadChanged maps a Deployment or DaemonSet to the pull secrets it
+// references and the one of its namespace, so they are collected once they
+// are no longer used.
+func (r *DestinationSecretReconciler) workloadChanged(obj client.Object) []reconcile.Request {
+	var podSpec *corev1.PodSpec
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		podSpec = &workload.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		podSpec = &workload.Spec.Template.Spec
+	default:
+		return nil
+	}
+	name := r.PullCredentials.secretName()
+	requests := []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+	for _, ref := range podSpec.ImagePullSecrets {
+		if ref.Name == name {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: ref.Name}})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DestinationSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.resync = make(chan event.GenericEvent)
+	if err := mgr.Add(manager.RunnableFunc(r.resyncOnChange)); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("destination-secret").
+		For(&corev1.Secret{}, builder.WithPredicates(predicate.NewPredicateFuncs(isManagedSecret))).
+		Watches(&source.Channel{Source: r.resync}, &handler.EnqueueRequestForObject{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.pullCredentialsChanged)).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.workloadChanged)).
+		Watches(&source.Kind{Type: &appsv1.DaemonSet{}}, handler.EnqueueRequestsFromMapFunc(r.workloadChanged)).
+		Complete(r)
+}
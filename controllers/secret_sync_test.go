@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// newManagedPullSecret returns the pull secret the controller creates in
+// namespace for the backup registry backup.io.
+func newManagedPullSecret(t *testing.T, namespace, username, password string) *corev1.Secret {
+	push := &RegistryCredentials{URL: "backup.io", Username: username, Password: password}
+	secret, err := getDestinationSecret(context.Background(), nil, nil, push, namespace)
+	require.NoError(t, err)
+	return secret
+}
+
+// newReferencingDeployment returns a Deployment in namespace using the pull
+// secret name.
+func newReferencingDeployment(namespace, name string) *appsv1.Deployment {
+	deployment := newE2EDeployment("backup.io/backup/app:1", name)
+	deployment.Namespace = namespace
+	return deployment
+}
+
+func TestCreateRegistrySecretUpdatesStaleData(t *testing.T) {
+	ctx := context.Background()
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).Build()
+
+	require.NoError(t, createRegistrySecret(ctx, k8sClient, newManagedPullSecret(t, "apps", "backup", "old-password")))
+	secret := newManagedPullSecret(t, "apps", "backup", "new-password")
+	require.NoError(t, createRegistrySecret(ctx, k8sClient, secret.DeepCopy()))
+
+	existing := &corev1.Secret{}
+	require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(secret), existing))
+	assert.Equal(t, secret.Data, existing.Data)
+	assert.Equal(t, "true", existing.Labels[MANAGED_LABEL])
+}
+
+func TestCreateRegistrySecretOwnership(t *testing.T) {
+	ctx := context.Background()
+	// a pull secret written by an earlier version
+	legacy, err := getDockerConfigSecret("backup", "old-password", "backup.io")
+	require.NoError(t, err)
+	legacy.Namespace = "legacy"
+	// a secret of the user with the same name
+	users, err := getDockerConfigSecret("someone", "password", "quay.io")
+	require.NoError(t, err)
+	users.Namespace = "apps"
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(legacy, users).Build()
+
+	err = createRegistrySecret(ctx, k8sClient, newManagedPullSecret(t, "apps", "backup", "password"))
+	assert.True(t, IsPermanentError(err))
+	existing := &corev1.Secret{}
+	require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(users), existing))
+	assert.Equal(t, users.Data, existing.Data)
+
+	adopted := newManagedPullSecret(t, "legacy", "backup", "new-password")
+	require.NoError(t, createRegistrySecret(ctx, k8sClient, adopted.DeepCopy()))
+	require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(legacy), existing))
+	assert.Equal(t, adopted.Data, existing.Data)
+	assert.Equal(t, "true", existing.Labels[MANAGED_LABEL])
+}
+
+func TestDestinationSecretSync(t *testing.T) {
+	ctx := context.Background()
+	stale := newManagedPullSecret(t, "apps", "backup", "old-password")
+	other := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "other"}}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithObjects(stale, other, newReferencingDeployment("apps", DESTINATION_SECRET_NAME)).Build()
+
+	credentials := NewBackupCredentials(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "old-password"})
+	r := &DestinationSecretReconciler{Client: k8sClient, Credentials: credentials, resync: make(chan event.GenericEvent)}
+
+	resyncCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() { _ = r.resyncOnChange(resyncCtx) }()
+
+	waitForResync := func() {
+		select {
+		case resynced := <-r.resync:
+			assert.Equal(t, DESTINATION_SECRET_NAME, resynced.Object.GetName())
+		case <-time.After(10 * time.Second):
+			t.Fatal("no resync of the registry secrets")
+		}
+	}
+	// on start
+	waitForResync()
+	credentials.Set(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "new-password"})
+	waitForResync()
+
+	key := types.NamespacedName{Namespace: "apps", Name: DESTINATION_SECRET_NAME}
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+
+	desired, err := getDockerConfigSecret("backup", "new-password", "backup.io")
+	require.NoError(t, err)
+	synced := &corev1.Secret{}
+	require.NoError(t, k8sClient.Get(ctx, key, synced))
+	assert.Equal(t, desired.Data, synced.Data)
+
+	// deleted secrets are left to the workload reconcilers
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "gone", Name: DESTINATION_SECRET_NAME}})
+	assert.NoError(t, err)
+}
+
+func TestDestinationSecretSyncPullCredentials(t *testing.T) {
+	ctx := context.Background()
+	global := types.NamespacedName{Namespace: "image-backup", Name: "pull-creds"}
+	stale := newManagedPullSecret(t, "apps", "backup", "push-password")
+	globalSecret := newPullCredentialsSecret(global.Namespace, global.Name, "reader", "pull-password")
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithObjects(stale, globalSecret, newReferencingDeployment("apps", DESTINATION_SECRET_NAME)).Build()
+
+	r := &DestinationSecretReconciler{
+		Client:          k8sClient,
+		Credentials:     NewBackupCredentials(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "push-password"}),
+		PullCredentials: &PullCredentials{Global: global},
+	}
+	key := types.NamespacedName{Namespace: "apps", Name: DESTINATION_SECRET_NAME}
+
+	// changes of the pull credentials reach the pull secrets built from them
+	assert.Equal(t, []ctrl.Request{{NamespacedName: key}}, r.pullCredentialsChanged(globalSecret))
+	assert.Equal(t, []ctrl.Request{{NamespacedName: key}},
+		r.pullCredentialsChanged(newPullCredentialsSecret("apps", PULL_CREDENTIALS_SECRET_NAME, "apps", "apps-password")))
+	assert.Empty(t, r.pullCredentialsChanged(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "other"}}))
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	require.NoError(t, err)
+
+	desired, err := getDockerConfigSecret("reader", "pull-password", "backup.io")
+	require.NoError(t, err)
+	synced := &corev1.Secret{}
+	require.NoError(t, k8sClient.Get(ctx, key, synced))
+	assert.Equal(t, desired.Data, synced.Data)
+}
+
+func TestDestinationSecretGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	unreferenced := newManagedPullSecret(t, "apps", "backup", "password")
+	referenced := newManagedPullSecret(t, "team-a", "backup", "password")
+	users := newManagedPullSecret(t, "team-b", "backup", "password")
+	users.Labels = nil
+	fresh := newManagedPullSecret(t, "team-c", "backup", "password")
+	fresh.CreationTimestamp = metav1.Now()
+	deployment := newReferencingDeployment("team-a", DESTINATION_SECRET_NAME)
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).
+		WithObjects(unreferenced, referenced, users, fresh, deployment).Build()
+
+	r := &DestinationSecretReconciler{
+		Client:      k8sClient,
+		Credentials: NewBackupCredentials(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "password"}),
+	}
+	reconcile := func(secret *corev1.Secret) ctrl.Result {
+		result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+		require.NoError(t, err)
+		return result
+	}
+	exists := func(secret *corev1.Secret) bool {
+		err := k8sClient.Get(ctx, client.ObjectKeyFromObject(secret), &corev1.Secret{})
+		return err == nil
+	}
+
+	reconcile(unreferenced)
+	assert.False(t, exists(unreferenced))
+	reconcile(referenced)
+	assert.True(t, exists(referenced))
+	reconcile(users)
+	assert.True(t, exists(users), "secrets of users are never deleted")
+	// new secrets get time for their workloads to be rewritten
+	assert.NotZero(t, reconcile(fresh).RequeueAfter)
+	assert.True(t, exists(fresh))
+
+	// deleting the workload collects its pull secret
+	assert.Equal(t, []ctrl.Request{{NamespacedName: client.ObjectKeyFromObject(referenced)}}, r.workloadChanged(deployment))
+	require.NoError(t, k8sClient.Delete(ctx, deployment))
+	reconcile(referenced)
+	assert.False(t, exists(referenced))
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ServiceAccountReconciler attaches the pull secret of the backup registry to
+// every ServiceAccount of the namespaces it exists in, if
+// PullCredentials.ServiceAccounts is set, so all pods inherit it. The entry is
+// removed again once the pull secret is deleted or the option is turned off.
+// Like on pod templates, the entry the controller added is recorded in
+// PULL_SECRET_ANNOTATION and other entries are never touched.
+type ServiceAccountReconciler struct {
+	client.Client
+	PullCredentials *PullCredentials
+}
+
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+
+func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	lg := log.FromContext(ctx)
+
+	serviceAccount := &corev1.ServiceAccount{}
+	err := r.Client.Get(ctx, req.NamespacedName, serviceAccount)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	attach := false
+	if r.PullCredentials.serviceAccounts() {
+		secret := &corev1.Secret{}
+		err := r.Client.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: r.PullCredentials.secretName()}, secret)
+		if err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		attach = err == nil && isManagedSecret(secret)
+	}
+
+	if err := updateServiceAccountPullSecret(ctx, r.Client, serviceAccount, r.PullCredentials.secretName(), attach); err != nil {
+		lg.Error(err, "failed to update service account")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// pullSecretChanged maps a pull secret of the backup registry to the
+// ServiceAccounts of its namespace.
+func (r *ServiceAccountReconciler) pullSecretChanged(obj client.Object) []reconcile.Request {
+	if !isManagedSecret(obj) {
+		return nil
+	}
+	ctx := context.Background()
+	serviceAccounts := &corev1.ServiceAccountList{}
+	if err := r.Client.List(ctx, serviceAccounts, client.InNamespace(obj.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list service accounts")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(serviceAccounts.Items))
+	for _, serviceAccount := range serviceAccounts.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&serviceAccount)})
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ServiceAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.ServiceAccount{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.pullSecretChanged)).
+		Complete(r)
+}
+
+// attachPullSecretToServiceAccount adds the pull secret name to the
+// ServiceAccount of podSpec. Pods only get the pull secrets their
+// ServiceAccount has when they are created, so workloads attach it before
+// they are rewritten.
+func attachPullSecretToServiceAccount(ctx context.Context, k8sClient client.Client, podSpec *corev1.PodSpec, namespace, name string) error {
+	serviceAccountName := podSpec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = DEFAULT_SERVICE_ACCOUNT
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace, Name: serviceAccountName}, serviceAccount); err != nil {
+		return err
+	}
+	return updateServiceAccountPullSecret(ctx, k8sClient, serviceAccount, name, true)
+}
+
+// updateServiceAccountPullSecret adds the pull secret name to serviceAccount
+// if attach is set and removes the one the controller added otherwise.
+func updateServiceAccountPullSecret(ctx context.Context, k8sClient client.Client, serviceAccount *corev1.ServiceAccount, name string, attach bool) error {
+	updated := serviceAccount.DeepCopy()
+	if attach {
+		addPullSecret(updated, &updated.ImagePullSecrets, name)
+	} else {
+		removePullSecret(updated, &updated.ImagePullSecrets)
+	}
+	if reflect.DeepEqual(serviceAccount.ImagePullSecrets, updated.ImagePullSecrets) &&
+		reflect.DeepEqual(serviceAccount.Annotations, updated.Annotations) {
+		return nil
+	}
+	return k8sClient.Update(ctx, updated)
+}
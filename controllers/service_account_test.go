@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServiceAccountReconciler(t *testing.T) {
+	ctx := context.Background()
+	secret := newManagedPullSecret(t, "apps", "backup", "password")
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Namespace: "apps", Name: "default"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "quay"}},
+	}
+	// no pull secret of the backup registry in its namespace
+	other := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "default"}}
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(secret, serviceAccount, other).Build()
+
+	pullCredentials := &PullCredentials{ServiceAccounts: true}
+	r := &ServiceAccountReconciler{Client: k8sClient, PullCredentials: pullCredentials}
+	reconcile := func(serviceAccount *corev1.ServiceAccount) *corev1.ServiceAccount {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(serviceAccount)})
+		require.NoError(t, err)
+		updated := &corev1.ServiceAccount{}
+		require.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(serviceAccount), updated))
+		return updated
+	}
+
+	updated := reconcile(serviceAccount)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "quay"}, {Name: DESTINATION_SECRET_NAME}}, updated.ImagePullSecrets)
+	assert.Equal(t, DESTINATION_SECRET_NAME, updated.Annotations[PULL_SECRET_ANNOTATION])
+	assert.Empty(t, reconcile(other).ImagePullSecrets)
+
+	// all ServiceAccounts of the namespace follow the pull secret
+	assert.Equal(t, []ctrl.Request{{NamespacedName: client.ObjectKeyFromObject(serviceAccount)}}, r.pullSecretChanged(secret))
+	assert.Empty(t, r.pullSecretChanged(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "quay"}}))
+
+	// reverting removes only the entry of the controller
+	pullCredentials.ServiceAccounts = false
+	updated = reconcile(serviceAccount)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "quay"}}, updated.ImagePullSecrets)
+	assert.NotContains(t, updated.Annotations, PULL_SECRET_ANNOTATION)
+
+	pullCredentials.ServiceAccounts = true
+	reconcile(serviceAccount)
+	require.NoError(t, k8sClient.Delete(ctx, secret))
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "quay"}}, reconcile(serviceAccount).ImagePullSecrets)
+}
+
+func TestDestinationSecretGarbageCollectionServiceAccounts(t *testing.T) {
+	ctx := context.Background()
+	used := newManagedPullSecret(t, "apps", "backup", "password")
+	unused := newManagedPullSecret(t, "team-a", "backup", "password")
+	// pods get the pull secret from their ServiceAccount
+	deployment := newE2EDeployment("backup.io/backup/app:1")
+	deployment.Namespace = "apps"
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(used, unused, deployment).Build()
+
+	r := &DestinationSecretReconciler{
+		Client:          k8sClient,
+		Credentials:     NewBackupCredentials(&RegistryCredentials{URL: "backup.io", Username: "backup", Password: "password"}),
+		PullCredentials: &PullCredentials{ServiceAccounts: true},
+	}
+	for _, secret := range []*corev1.Secret{used, unused} {
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+		require.NoError(t, err)
+	}
+	assert.NoError(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(used), &corev1.Secret{}))
+	assert.Error(t, k8sClient.Get(ctx, client.ObjectKeyFromObject(unused), &corev1.Secret{}))
+}
+
+func TestReconcileAttachesPullSecretToServiceAccount(t *testing.T) {
+	src := newTestRegistry(t, "user1", "password1")
+	dst := newTestRegistry(t, "backup", "backup-password")
+	src.PushImage(t, "library/app", "v1")
+
+	registryManager := registryManagerFactories[REGISTRY_BACKEND_DISTRIBUTION](testRegistryConfig(t, src, dst), t)
+	deployment := newE2EDeployment(src.Host+"/library/app:v1", "src-creds")
+	deployment.Spec.Template.Spec.ServiceAccountName = "app"
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"}}
+	h := newE2EHarness(t, registryManager, dst, deployment, serviceAccount, newE2EPullSecret("src-creds", src.Host, "user1", "password1"))
+	r := h.deploymentReconciler()
+	r.PullCredentials = &PullCredentials{ServiceAccounts: true}
+
+	h.reconcileUntilDone(t, r, deployment)
+
+	updated := &appsv1.Deployment{}
+	require.NoError(t, h.client.Get(context.Background(), client.ObjectKeyFromObject(deployment), updated))
+	assert.Equal(t, dst.Host+"/backup/app:v1", updated.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "src-creds"}}, updated.Spec.Template.Spec.ImagePullSecrets)
+
+	require.NoError(t, h.client.Get(context.Background(), client.ObjectKeyFromObject(serviceAccount), serviceAccount))
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: DESTINATION_SECRET_NAME}}, serviceAccount.ImagePullSecrets)
+}
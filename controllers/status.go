@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// STATUS_ANNOTATION holds the backup status of a workload as JSON. It is
+	// only written if status reporting is enabled.
+	STATUS_ANNOTATION = "imagebackup.junaidk.io/status"
+)
+
+type BackupStatus struct {
+	Images []ImageBackupStatus `json:"images"`
+}
+
+type ImageBackupStatus struct {
+	Image       string `json:"image"`
+	Destination string `json:"destination"`
+	// BackupDestination names where Destination is, "primary" for the
+	// backup registry workloads are rewritten to.
+	BackupDestination string    `json:"backupDestination"`
+	State             CopyState `json:"state"`
+	BytesCopied       int64     `json:"bytesCopied,omitempty"`
+	BytesTotal        int64     `json:"bytesTotal,omitempty"`
+	Message           string    `json:"message,omitempty"`
+	// Scan is the verdict of the scanner on the backup image, if enabled.
+	Scan *ScanResult `json:"scan,omitempty"`
+}
+
+func newBackupStatus(jobs []CopyJob, statuses []CopyStatus) *BackupStatus {
+	backupStatus := &BackupStatus{Images: make([]ImageBackupStatus, 0, len(jobs))}
+	for i, job := range jobs {
+		imageStatus := ImageBackupStatus{
+			Image:             job.SrcImage,
+			Destination:       job.DstImage,
+			BackupDestination: job.destinationName(),
+			State:             statuses[i].State,
+			BytesCopied:       statuses[i].BytesCopied,
+			BytesTotal:        statuses[i].BytesTotal,
+		}
+		if statuses[i].Err != nil {
+			imageStatus.Message = statuses[i].Err.Error()
+		}
+		backupStatus.Images = append(backupStatus.Images, imageStatus)
+	}
+	return backupStatus
+}
+
+// setScanResults adds the scan results of the primary backup images, keyed by
+// source image, to status.
+func (s *BackupStatus) setScanResults(results map[string]ScanResult) *BackupStatus {
+	for i := range s.Images {
+		if result, ok := results[s.Images[i].Image]; ok && s.Images[i].BackupDestination == PRIMARY_DESTINATION {
+			result := result
+			s.Images[i].Scan = &result
+		}
+	}
+	return s
+}
+
+// setBackupStatus writes status to the status annotation of obj and reports
+// whether the annotation changed.
+func setBackupStatus(obj client.Object, status *BackupStatus) bool {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return false
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	if annotations[STATUS_ANNOTATION] == string(data) {
+		return false
+	}
+	annotations[STATUS_ANNOTATION] = string(data)
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// updateBackupStatus writes status to the status annotation of obj and updates
+// obj if the annotation changed.
+func updateBackupStatus(ctx context.Context, k8sClient client.Client, obj client.Object, status *BackupStatus) error {
+	if !setBackupStatus(obj, status) {
+		return nil
+	}
+	return k8sClient.Update(ctx, obj)
+}
@@ -73,27 +73,37 @@ var _ = BeforeSuite(func(done Done) {
 	})
 	Expect(err).ToNot(HaveOccurred())
 
+	// a single worker keeps the copy order of the tests deterministic
+	copyQueue1 := NewCopyQueue(testRegistryManager1, 1)
+	Expect(k8sManager.Add(copyQueue1)).To(Succeed())
+	copyQueue2 := NewCopyQueue(testRegistryManager2, 1)
+	Expect(k8sManager.Add(copyQueue2)).To(Succeed())
+
 	err = (&DeploymentImageBackupReconciler{
-		Client:          k8sManager.GetClient(),
-		Scheme:          k8sManager.GetScheme(),
-		RegistryManager: testRegistryManager1,
-		BackUpRegistryCredentials: &RegistryCredentials{
+		Client:    k8sManager.GetClient(),
+		Scheme:    k8sManager.GetScheme(),
+		CopyQueue: copyQueue1,
+		BackUpRegistryCredentials: NewBackupCredentials(&RegistryCredentials{
 			URL:      DEFAULT_DOCKER_REGISTRY,
 			Username: "user",
 			Password: "password",
-		},
+		}),
+		RetryPolicy: DefaultRetryPolicy(),
+		Recorder:    k8sManager.GetEventRecorderFor("deployment-image-backup"),
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
 	err = (&DaemonsetImageBackupReconciler{
-		Client:          k8sManager.GetClient(),
-		Scheme:          k8sManager.GetScheme(),
-		RegistryManager: testRegistryManager2,
-		BackUpRegistryCredentials: &RegistryCredentials{
+		Client:    k8sManager.GetClient(),
+		Scheme:    k8sManager.GetScheme(),
+		CopyQueue: copyQueue2,
+		BackUpRegistryCredentials: NewBackupCredentials(&RegistryCredentials{
 			URL:      DEFAULT_DOCKER_REGISTRY,
 			Username: "user",
 			Password: "password",
-		},
+		}),
+		RetryPolicy: DefaultRetryPolicy(),
+		Recorder:    k8sManager.GetEventRecorderFor("daemonset-image-backup"),
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
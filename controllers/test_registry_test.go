@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	testListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	testConfigMediaType   = "application/vnd.docker.container.image.v1+json"
+	testLayerMediaType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// testRegistry is an in-memory registry implementing the parts of the
+// distribution API used to copy images. If username is set every request
+// needs basic auth, if token is set the bearer token.
+type testRegistry struct {
+	server   *httptest.Server
+	Host     string
+	username string
+	password string
+	token    string
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string]testManifest
+	uploads   map[string]*bytes.Buffer
+}
+
+type testManifest struct {
+	mediaType string
+	data      []byte
+}
+
+var testRegistryPathRegexp = regexp.MustCompile(`^/v2/(.+)/(blobs/uploads/?|blobs/uploads/([^/]+)|blobs/([^/]+)|manifests/([^/]+))$`)
+
+// newTestRegistry starts a TLS registry. All test registries share the
+// certificate of httptest, CertDir holds its CA.
+func newTestRegistry(t *testing.T, username, password string) *testRegistry {
+	r := &testRegistry{
+		username:  username,
+		password:  password,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]testManifest),
+		uploads:   make(map[string]*bytes.Buffer),
+	}
+	r.server = httptest.NewTLSServer(r)
+	t.Cleanup(r.server.Close)
+	r.Host = strings.TrimPrefix(r.server.URL, "https://")
+	return r
+}
+
+// newTestTokenRegistry starts a TLS registry that only accepts token as
+// bearer token.
+func newTestTokenRegistry(t *testing.T, token string) *testRegistry {
+	r := newTestRegistry(t, "", "")
+	r.token = token
+	return r
+}
+
+// CertDir returns a directory with the CA of the test registries in the
+// layout of docker's certs.d.
+func (r *testRegistry) CertDir(t *testing.T) string {
+	certDir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: r.server.Certificate().Raw})
+	if err := ioutil.WriteFile(filepath.Join(certDir, "ca.crt"), ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certDir
+}
+
+// Manifest returns the manifest of repository at reference, a tag or digest.
+func (r *testRegistry) Manifest(repository, reference string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	manifest, ok := r.manifests[repository+":"+reference]
+	return manifest.data, ok
+}
+
+// PushImage stores a single layer linux/amd64 image at repository:tag and
+// returns its manifest.
+func (r *testRegistry) PushImage(t *testing.T, repository, tag string) []byte {
+	layerContent := make([]byte, 1024)
+	if _, err := rand.Read(layerContent); err != nil {
+		t.Fatal(err)
+	}
+	var layerTar bytes.Buffer
+	tw := tar.NewWriter(&layerTar)
+	_ = tw.WriteHeader(&tar.Header{Name: "data", Mode: 0644, Size: int64(len(layerContent))})
+	_, _ = tw.Write(layerContent)
+	_ = tw.Close()
+	var layer bytes.Buffer
+	gw := gzip.NewWriter(&layer)
+	_, _ = gw.Write(layerTar.Bytes())
+	_ = gw.Close()
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{sha256Digest(layerTar.Bytes())}},
+	})
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     testManifestMediaType,
+		"config":        map[string]interface{}{"mediaType": testConfigMediaType, "size": len(config), "digest": sha256Digest(config)},
+		"layers": []map[string]interface{}{
+			{"mediaType": testLayerMediaType, "size": layer.Len(), "digest": sha256Digest(layer.Bytes())},
+		},
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[sha256Digest(config)] = config
+	r.blobs[sha256Digest(layer.Bytes())] = layer.Bytes()
+	r.putManifest(repository, tag, testManifestMediaType, manifest)
+	return manifest
+}
+
+// PushImageList stores a manifest list of a linux/amd64 and a linux/arm64
+// image at repository:tag and returns it.
+func (r *testRegistry) PushImageList(t *testing.T, repository, tag string) []byte {
+	var manifests []map[string]interface{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		manifest := r.PushImage(t, repository, tag+"-"+arch)
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": testManifestMediaType,
+			"size":      len(manifest),
+			"digest":    sha256Digest(manifest),
+			"platform":  map[string]string{"architecture": arch, "os": "linux"},
+		})
+	}
+	list, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     testListMediaType,
+		"manifests":     manifests,
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.putManifest(repository, tag, testListMediaType, list)
+	return list
+}
+
+// putManifest must be called with r.mu held.
+func (r *testRegistry) putManifest(repository, reference, mediaType string, data []byte) string {
+	dgst := sha256Digest(data)
+	r.manifests[repository+":"+reference] = testManifest{mediaType: mediaType, data: data}
+	r.manifests[repository+":"+dgst] = testManifest{mediaType: mediaType, data: data}
+	return dgst
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test-registry"`)
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+	}
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, r.server.URL))
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	if req.URL.Path == "/v2/" || req.URL.Path == "/v2" {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		return
+	}
+
+	m := testRegistryPathRegexp.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "unknown path")
+		return
+	}
+	repository := m[1]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(m[2], "blobs/uploads") && m[3] == "":
+		r.startUpload(w, req, repository)
+	case m[3] != "":
+		r.upload(w, req, repository, m[3])
+	case m[4] != "":
+		r.blob(w, req, m[4])
+	default:
+		r.manifest(w, req, repository, m[5])
+	}
+}
+
+func (r *testRegistry) startUpload(w http.ResponseWriter, req *http.Request, repository string) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	uuid := hex.EncodeToString(id)
+	r.uploads[uuid] = &bytes.Buffer{}
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, uuid))
+	w.Header().Set("Docker-Upload-UUID", uuid)
+	w.Header().Set("Range", "0-0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *testRegistry) upload(w http.ResponseWriter, req *http.Request, repository, uuid string) {
+	buf, ok := r.uploads[uuid]
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "unknown upload")
+		return
+	}
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	buf.Write(data)
+
+	switch req.Method {
+	case http.MethodPatch:
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repository, uuid))
+		w.Header().Set("Docker-Upload-UUID", uuid)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		dgst := req.URL.Query().Get("digest")
+		if dgst != sha256Digest(buf.Bytes()) {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+			return
+		}
+		delete(r.uploads, uuid)
+		r.blobs[dgst] = buf.Bytes()
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repository, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(r.uploads, uuid)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *testRegistry) blob(w http.ResponseWriter, req *http.Request, dgst string) {
+	data, ok := r.blobs[dgst]
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+	w.Header().Set("Docker-Content-Digest", dgst)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func (r *testRegistry) manifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	if req.Method == http.MethodPut {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dgst := r.putManifest(repository, reference, req.Header.Get("Content-Type"), data)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", repository, dgst))
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	manifest, ok := r.manifests[repository+":"+reference]
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+		return
+	}
+	w.Header().Set("Content-Type", manifest.mediaType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(manifest.data)))
+	w.Header().Set("Docker-Content-Digest", sha256Digest(manifest.data))
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(manifest.data)
+	}
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+}
+
+func sha256Digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
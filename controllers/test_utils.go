@@ -11,6 +11,10 @@ func (tr *TestRegistryManager) CopyImage(ctx context.Context, srcImage, dstImage
 	return nil
 }
 
+func (tr *TestRegistryManager) ImageSize(ctx context.Context, srcImage string, srcRegistryCredentials *RegistryCredentials) (int64, error) {
+	return 0, nil
+}
+
 var SrcImageNames = []string{"library/image1", "quay.io/notcache/image2"}
 var DstImageNames = []string{"index.docker.io/user/image1", "index.docker.io/user/image2"}
 
@@ -3,14 +3,21 @@ module github.com/junaidk/image-backup-controller
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/containers/common v0.44.4
 	github.com/containers/image/v5 v5.17.0
+	github.com/docker/distribution v2.7.1+incompatible
+	github.com/go-logr/logr v0.4.0
 	github.com/onsi/ginkgo v1.16.5
 	github.com/onsi/gomega v1.16.0
+	github.com/prometheus/client_golang v1.11.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 	k8s.io/api v0.22.1
 	k8s.io/apimachinery v0.22.1
 	k8s.io/client-go v0.22.1
 	k8s.io/utils v0.0.0-20211116205334-6203023598ed
 	sigs.k8s.io/controller-runtime v0.10.0
+	sigs.k8s.io/yaml v1.2.0
 )
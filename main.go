@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/junaidk/image-backup-controller/controllers"
 
@@ -27,6 +30,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -50,11 +54,14 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var registryBackend string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&registryBackend, "registry-backend", registryBackends[0],
+		"The library images are copied with, one of "+strings.Join(registryBackends, ", ")+".")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -63,13 +70,28 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	copyTimeout, err := controllers.GetCopyTimeoutEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get copyTimeout")
+		os.Exit(1)
+	}
+
+	copyShutdownTimeout, err := controllers.GetCopyShutdownTimeoutEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get copyShutdownTimeout")
+		os.Exit(1)
+	}
+	// leave the copy queue time to drain before the manager gives up on it
+	gracefulShutdownTimeout := copyShutdownTimeout + 15*time.Second
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "517e2176.junaidk.io",
+		Scheme:                  scheme,
+		MetricsBindAddress:      metricsAddr,
+		Port:                    9443,
+		HealthProbeBindAddress:  probeAddr,
+		LeaderElection:          enableLeaderElection,
+		LeaderElectionID:        "517e2176.junaidk.io",
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -82,17 +104,57 @@ func main() {
 		os.Exit(1)
 	}
 
-	backupRegistryUserName, err := controllers.GetBackUpRegistryUserNameEnv()
+	var backUpRegistryCredentials *controllers.RegistryCredentials
+	backUpRegistrySecretNamespace, backUpRegistrySecretName, err := controllers.GetBackUpRegistrySecretEnv()
 	if err != nil {
-		setupLog.Error(err, "unable to get backupRegistryUserName")
+		setupLog.Error(err, "unable to get backUpRegistrySecret")
 		os.Exit(1)
 	}
+	backUpRegistrySecretKey := types.NamespacedName{Namespace: backUpRegistrySecretNamespace, Name: backUpRegistrySecretName}
+	if backUpRegistrySecretName != "" {
+		// the secret may leave the username to the environment
+		backupRegistryUserName, _ := controllers.GetBackUpRegistryUserNameEnv()
+		backUpRegistryCredentials, err = controllers.LoadBackupCredentials(context.Background(), mgr.GetAPIReader(), backUpRegistrySecretKey, backUpRegistryURL, backupRegistryUserName)
+		if err != nil {
+			setupLog.Error(err, "unable to load backUpRegistryCredentials")
+			os.Exit(1)
+		}
+	} else {
+		backupRegistryUserName, err := controllers.GetBackUpRegistryUserNameEnv()
+		if err != nil {
+			setupLog.Error(err, "unable to get backupRegistryUserName")
+			os.Exit(1)
+		}
+
+		backUpRegistryPassword, err := controllers.GetBackUpRegistryPasswordEnv()
+		if err != nil {
+			setupLog.Error(err, "unable to get backUpRegistryPassword")
+			os.Exit(1)
+		}
+
+		backUpRegistryCredentials = &controllers.RegistryCredentials{
+			URL:      backUpRegistryURL,
+			Username: backupRegistryUserName,
+			Password: backUpRegistryPassword,
+		}
+	}
+	backUpCredentials := controllers.NewBackupCredentials(backUpRegistryCredentials)
 
-	backUpRegistryPassword, err := controllers.GetBackUpRegistryPasswordEnv()
+	pullSecretNamespace, pullSecretName, err := controllers.GetBackUpRegistryPullSecretEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get backUpRegistryPullSecret")
+		os.Exit(1)
+	}
+	pullSecretServiceAccounts, err := controllers.GetPullSecretServiceAccountsEnv()
 	if err != nil {
-		setupLog.Error(err, "unable to get backUpRegistryPassword")
+		setupLog.Error(err, "unable to get pullSecretServiceAccounts")
 		os.Exit(1)
 	}
+	pullCredentials := &controllers.PullCredentials{
+		Global:          types.NamespacedName{Namespace: pullSecretNamespace, Name: pullSecretName},
+		SecretName:      controllers.GetPullSecretNameEnv(),
+		ServiceAccounts: pullSecretServiceAccounts,
+	}
 
 	ignoreNamespaces := controllers.GetIgnoreNamespacesEnv()
 
@@ -101,37 +163,197 @@ func main() {
 		ignoreNamespaces = append(ignoreNamespaces, controllerNamespace)
 	}
 
-	containerRegistryManger := &controllers.ContainerRegistryManager{}
+	retryPolicy, err := controllers.GetRetryPolicyEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get retryPolicy")
+		os.Exit(1)
+	}
+
+	registryConfig, err := controllers.LoadRegistryConfig(controllers.GetRegistryConfigPathEnv())
+	if err != nil {
+		setupLog.Error(err, "unable to load registryConfig")
+		os.Exit(1)
+	}
+
+	registriesConfPath := controllers.GetRegistriesConfPathEnv()
+	if registriesConfPath != "" {
+		if err := controllers.ValidateRegistriesConf(registriesConfPath); err != nil {
+			setupLog.Error(err, "unable to load registriesConf")
+			os.Exit(1)
+		}
+	}
+
+	progressInterval, err := controllers.GetCopyProgressIntervalEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get progressInterval")
+		os.Exit(1)
+	}
+
+	reportStatus := controllers.GetReportStatusEnv()
+
+	maxImageSize, err := controllers.GetMaxImageSizeEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get maxImageSize")
+		os.Exit(1)
+	}
+
+	blobInfoCacheDir := controllers.GetBlobInfoCacheDirEnv()
+	copyTempDir := controllers.GetCopyTempDirEnv()
+	for _, dir := range []string{blobInfoCacheDir, copyTempDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			setupLog.Error(err, "unable to create directory", "dir", dir)
+			os.Exit(1)
+		}
+	}
+
+	registryBackendOptions := registryBackendOptions{
+		RegistryConfig:     registryConfig,
+		RetryPolicy:        retryPolicy,
+		RateLimiter:        controllers.NewRegistryRateLimiter(registryConfig),
+		ProgressInterval:   progressInterval,
+		BlobInfoCacheDir:   blobInfoCacheDir,
+		TemporaryDir:       copyTempDir,
+		RegistriesConfPath: registriesConfPath,
+		CredentialHelpers:  controllers.NewCredentialHelpers(registryConfig),
+	}
+
+	copyWorkers, err := controllers.GetCopyWorkersEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get copyWorkers")
+		os.Exit(1)
+	}
+
+	registryManager, err := newRegistryBackend(registryBackend, registryBackendOptions)
+	if err != nil {
+		setupLog.Error(err, "unable to create registry backend", "registryBackend", registryBackend)
+		os.Exit(1)
+	}
+
+	destinations, err := controllers.LoadBackupDestinations(registryConfig, registryManager)
+	if err != nil {
+		setupLog.Error(err, "unable to load backup destinations")
+		os.Exit(1)
+	}
+
+	archiveDir, archiveFormat, err := controllers.GetBackupArchiveEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get backupArchive")
+		os.Exit(1)
+	}
+	if archiveDir != "" {
+		if err := os.MkdirAll(archiveDir, 0755); err != nil {
+			setupLog.Error(err, "unable to create directory", "dir", archiveDir)
+			os.Exit(1)
+		}
+		archiveRegistryManager, err := newArchiveRegistryManager(registryBackendOptions, archiveDir, archiveFormat)
+		if err != nil {
+			setupLog.Error(err, "unable to create backup archive")
+			os.Exit(1)
+		}
+		// the archive is named like the backup registry images
+		destinations = append(destinations, controllers.BackupDestination{
+			Name: controllers.ARCHIVE_DESTINATION,
+			Credentials: &controllers.RegistryCredentials{
+				URL:      backUpRegistryURL,
+				Username: backUpRegistryCredentials.Username,
+			},
+			RegistryManager: archiveRegistryManager,
+		})
+	}
+
+	backupPolicy, err := controllers.GetBackupPolicyEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get backupPolicy")
+		os.Exit(1)
+	}
+
+	scanner, err := controllers.GetImageScannerEnv()
+	if err != nil {
+		setupLog.Error(err, "unable to get scanner")
+		os.Exit(1)
+	}
+
+	copyQueue := controllers.NewCopyQueue(registryManager, copyWorkers)
+	copyQueue.Destinations = controllers.DestinationRegistryManagers(destinations)
+	copyQueue.BackupCredentials = backUpCredentials
+	copyQueue.CopyTimeout = copyTimeout
+	copyQueue.ShutdownTimeout = copyShutdownTimeout
+	copyQueue.Scanner = scanner
+	if err = mgr.Add(copyQueue); err != nil {
+		setupLog.Error(err, "unable to add copy queue")
+		os.Exit(1)
+	}
 
 	if err = (&controllers.DeploymentImageBackupReconciler{
-		Client:          mgr.GetClient(),
-		Scheme:          mgr.GetScheme(),
-		RegistryManager: containerRegistryManger,
-		BackUpRegistryCredentials: &controllers.RegistryCredentials{
-			URL:      backUpRegistryURL,
-			Username: backupRegistryUserName,
-			Password: backUpRegistryPassword,
-		},
-		IgnoreNamespaces: ignoreNamespaces,
+		Client:                    mgr.GetClient(),
+		Scheme:                    mgr.GetScheme(),
+		CopyQueue:                 copyQueue,
+		BackUpRegistryCredentials: backUpCredentials,
+		IgnoreNamespaces:          ignoreNamespaces,
+		RetryPolicy:               retryPolicy,
+		MaxImageSize:              maxImageSize,
+		ReportStatus:              reportStatus,
+		ProgressInterval:          progressInterval,
+		Destinations:              destinations,
+		BackupPolicy:              backupPolicy,
+		PullCredentials:           pullCredentials,
+		Recorder:                  mgr.GetEventRecorderFor("deployment-image-backup"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DeploymentImageBackup")
 		os.Exit(1)
 	}
 
 	if err = (&controllers.DaemonsetImageBackupReconciler{
-		Client:          mgr.GetClient(),
-		Scheme:          mgr.GetScheme(),
-		RegistryManager: containerRegistryManger,
-		BackUpRegistryCredentials: &controllers.RegistryCredentials{
-			URL:      backUpRegistryURL,
-			Username: backupRegistryUserName,
-			Password: backUpRegistryPassword,
-		},
-		IgnoreNamespaces: ignoreNamespaces,
+		Client:                    mgr.GetClient(),
+		Scheme:                    mgr.GetScheme(),
+		CopyQueue:                 copyQueue,
+		BackUpRegistryCredentials: backUpCredentials,
+		IgnoreNamespaces:          ignoreNamespaces,
+		RetryPolicy:               retryPolicy,
+		MaxImageSize:              maxImageSize,
+		ReportStatus:              reportStatus,
+		ProgressInterval:          progressInterval,
+		Destinations:              destinations,
+		BackupPolicy:              backupPolicy,
+		PullCredentials:           pullCredentials,
+		Recorder:                  mgr.GetEventRecorderFor("daemonset-image-backup"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DaemonsetImageBackup")
 		os.Exit(1)
 	}
+
+	if err = (&controllers.DestinationSecretReconciler{
+		Client:          mgr.GetClient(),
+		Credentials:     backUpCredentials,
+		PullCredentials: pullCredentials,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DestinationSecret")
+		os.Exit(1)
+	}
+
+	if err = (&controllers.ServiceAccountReconciler{
+		Client:          mgr.GetClient(),
+		PullCredentials: pullCredentials,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ServiceAccount")
+		os.Exit(1)
+	}
+
+	if backUpRegistrySecretName != "" {
+		if err = (&controllers.BackupCredentialsReconciler{
+			Client:      mgr.GetClient(),
+			SecretKey:   backUpRegistrySecretKey,
+			Credentials: backUpCredentials,
+			Validate:    registryManager.CheckCredentials,
+			Recorder:    mgr.GetEventRecorderFor("backup-credentials"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "BackupCredentials")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
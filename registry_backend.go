@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/junaidk/image-backup-controller/controllers"
+)
+
+// registryBackend is the RegistryManager images are copied with, it also
+// checks reloaded credentials of the backup registry.
+type registryBackend interface {
+	controllers.RegistryManager
+	CheckCredentials(ctx context.Context, credentials *controllers.RegistryCredentials) error
+}
+
+// registryBackendOptions configure the RegistryManagers of all backends.
+type registryBackendOptions struct {
+	RegistryConfig     *controllers.RegistryConfig
+	RetryPolicy        controllers.RetryPolicy
+	RateLimiter        *controllers.RegistryRateLimiter
+	ProgressInterval   time.Duration
+	BlobInfoCacheDir   string
+	TemporaryDir       string
+	RegistriesConfPath string
+	CredentialHelpers  *controllers.CredentialHelpers
+}
+
+func newDistributionRegistryManager(options registryBackendOptions) *controllers.DistributionRegistryManager {
+	return &controllers.DistributionRegistryManager{
+		RegistryConfig:     options.RegistryConfig,
+		RetryPolicy:        options.RetryPolicy,
+		RateLimiter:        options.RateLimiter,
+		ProgressInterval:   options.ProgressInterval,
+		RegistriesConfPath: options.RegistriesConfPath,
+		CredentialHelpers:  options.CredentialHelpers,
+	}
+}